@@ -5,67 +5,30 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"strconv"
 
 	"github.com/elastic/go-elasticsearch/v8/esapi"
 )
 
+// ParseResponse parses the hits of a search response into a slice of the specified type.
+// Hits that fail to decode are logged and skipped; use ParseSearchResult for totals,
+// IDs, highlights, aggregations and decode errors.
 func ParseResponse[T any](res *esapi.Response) ([]T, error) {
-	var result struct {
-		Hits struct {
-			Hits []struct {
-				Source map[string]interface{} `json:"_source"` // Use map for flexible field handling
-			} `json:"hits"`
-		} `json:"hits"`
+	result, err := ParseSearchResult[T](res)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to decode response body: %v", err)
+	for _, decodeErr := range result.DecodeErrors {
+		log.Printf("Error unmarshalling hit: %v", decodeErr)
 	}
 
 	var items []T
-	for _, hit := range result.Hits.Hits {
-		// Normalize fields before unmarshalling into the target struct
-		normalizeNumericFields(hit.Source)
-
-		// Marshal the normalized map back to JSON
-		data, err := json.Marshal(hit.Source)
-		if err != nil {
-			log.Printf("Error marshaling normalized data: %v", err)
-			continue
-		}
-
-		// Unmarshal into the target struct
-		var item T
-		if err := json.Unmarshal(data, &item); err != nil {
-			log.Printf("Error unmarshalling hit: %v", err)
-			continue
-		}
-		items = append(items, item)
+	for _, hit := range result.Hits {
+		items = append(items, hit.Source)
 	}
-
 	return items, nil
 }
 
-func normalizeNumericFields(data map[string]interface{}) {
-	for key, value := range data {
-		switch v := value.(type) {
-		case map[string]interface{}: // Recurse for nested fields
-			normalizeNumericFields(v)
-		case []interface{}: // Handle arrays of nested fields
-			for _, item := range v {
-				if m, ok := item.(map[string]interface{}); ok {
-					normalizeNumericFields(m)
-				}
-			}
-		case string: // Convert numeric strings to float64
-			if f, err := strconv.ParseFloat(v, 64); err == nil {
-				data[key] = f
-			}
-		}
-	}
-}
-
 // MapToReader converts a map to a JSON reader for Elasticsearch queries.
 func MapToReader(query map[string]interface{}) (*bytes.Reader, error) {
 	body, err := json.Marshal(query)
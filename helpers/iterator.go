@@ -0,0 +1,249 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"log"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// IterateOptions configures a deep pagination iterator
+type IterateOptions struct {
+	Index     string
+	BatchSize int           // Hits per batch, default 1000
+	KeepAlive time.Duration // How long the point in time or scroll stays open between batches, default 1m
+	Routing   string        // Shard routing, e.g. Tenancy.Routing
+	UseScroll bool          // Use the scroll API instead of a point in time
+}
+
+// Iterate yields every hit of a search in batches, beyond the 10,000 hit limit of from/size.
+// It pages with a point in time and search_after, falling back to scroll when a point in time
+// cannot be opened, and closes the point in time or scroll when iteration ends or the loop breaks.
+// The from and size of the search are ignored. A batch with hits that could not be decoded is
+// yielded with the decoded hits and a joined HitDecodeError; any other error ends the iteration.
+//
+//	for batch, err := range helpers.Iterate[Sph](ctx, es, helpers.NewSearch().Query(q), options) {
+//		if err != nil { ... }
+//	}
+func Iterate[T any](ctx context.Context, es *elasticsearch.Client, search *SearchBuilder, options IterateOptions) iter.Seq2[[]SearchHit[T], error] {
+	if options.BatchSize <= 0 {
+		options.BatchSize = 1000
+	}
+	if options.KeepAlive <= 0 {
+		options.KeepAlive = time.Minute
+	}
+
+	return func(yield func([]SearchHit[T], error) bool) {
+		body := search.Build()
+		delete(body, "from")
+		body["size"] = options.BatchSize
+
+		if !options.UseScroll {
+			pitID, err := openPointInTime(ctx, es, options)
+			if err == nil {
+				iteratePointInTime(ctx, es, body, pitID, options, yield)
+				return
+			}
+			log.Printf("Falling back to scroll for index %s: %v", options.Index, err)
+		}
+		iterateScroll(ctx, es, body, options, yield)
+	}
+}
+
+// openPointInTime opens a point in time on the index
+func openPointInTime(ctx context.Context, es *elasticsearch.Client, options IterateOptions) (string, error) {
+	request := []func(*esapi.OpenPointInTimeRequest){
+		es.OpenPointInTime.WithContext(ctx),
+	}
+	if options.Routing != "" {
+		request = append(request, es.OpenPointInTime.WithRouting(options.Routing))
+	}
+
+	res, err := es.OpenPointInTime([]string{options.Index}, keepAlive(options.KeepAlive), request...)
+	if err != nil {
+		return "", fmt.Errorf("failed to open point in time: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", NewElasticsearchError(res)
+	}
+
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("failed to decode point in time: %w", err)
+	}
+	return response.ID, nil
+}
+
+// iteratePointInTime pages through a point in time with search_after
+func iteratePointInTime[T any](ctx context.Context, es *elasticsearch.Client, body map[string]interface{}, pitID string, options IterateOptions, yield func([]SearchHit[T], error) bool) {
+	defer func() {
+		closePointInTime(es, pitID)
+	}()
+
+	if _, exists := body["sort"]; !exists {
+		body["sort"] = []interface{}{map[string]interface{}{"_shard_doc": "asc"}}
+	}
+
+	for {
+		body["pit"] = map[string]interface{}{
+			"id":         pitID,
+			"keep_alive": keepAlive(options.KeepAlive),
+		}
+
+		// Index and routing are fixed by the point in time
+		result, err := searchPage[T](es, body, []func(*esapi.SearchRequest){
+			es.Search.WithContext(ctx),
+		})
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		if result.PitID != "" {
+			pitID = result.PitID // The point in time ID may change between requests
+		}
+
+		total := len(result.Hits) + len(result.DecodeErrors)
+		if total == 0 {
+			return
+		}
+		if !yield(result.Hits, result.Err()) {
+			return
+		}
+		if total < options.BatchSize {
+			return
+		}
+
+		lastSort := result.LastSort()
+		if lastSort == nil {
+			yield(nil, fmt.Errorf("hits of index %s have no sort values to continue from", options.Index))
+			return
+		}
+		body["search_after"] = lastSort
+	}
+}
+
+// iterateScroll pages through a scroll
+func iterateScroll[T any](ctx context.Context, es *elasticsearch.Client, body map[string]interface{}, options IterateOptions, yield func([]SearchHit[T], error) bool) {
+	if _, exists := body["sort"]; !exists {
+		body["sort"] = []interface{}{"_doc"}
+	}
+
+	request := []func(*esapi.SearchRequest){
+		es.Search.WithContext(ctx),
+		es.Search.WithIndex(options.Index),
+		es.Search.WithScroll(options.KeepAlive),
+	}
+	if options.Routing != "" {
+		request = append(request, es.Search.WithRouting(options.Routing))
+	}
+
+	result, err := searchPage[T](es, body, request)
+	if err != nil {
+		yield(nil, err)
+		return
+	}
+
+	scrollID := result.ScrollID
+	defer func() {
+		clearScroll(es, scrollID)
+	}()
+
+	for {
+		if len(result.Hits)+len(result.DecodeErrors) == 0 {
+			return
+		}
+		if !yield(result.Hits, result.Err()) {
+			return
+		}
+
+		res, err := es.Scroll(
+			es.Scroll.WithContext(ctx),
+			es.Scroll.WithScrollID(scrollID),
+			es.Scroll.WithScroll(options.KeepAlive),
+		)
+		if err != nil {
+			yield(nil, fmt.Errorf("failed to scroll: %w", err))
+			return
+		}
+		result, err = ParseSearchResult[T](res)
+		res.Body.Close()
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		if result.ScrollID != "" {
+			scrollID = result.ScrollID
+		}
+	}
+}
+
+// searchPage runs one search request and decodes its hits
+func searchPage[T any](es *elasticsearch.Client, body map[string]interface{}, request []func(*esapi.SearchRequest)) (*SearchResult[T], error) {
+	reader, err := MapToReader(body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := es.Search(append(request, es.Search.WithBody(reader))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search: %w", err)
+	}
+	defer res.Body.Close()
+
+	return ParseSearchResult[T](res)
+}
+
+// closePointInTime releases a point in time; failures only log since it expires anyway
+func closePointInTime(es *elasticsearch.Client, pitID string) {
+	body, err := MapToReader(map[string]interface{}{"id": pitID})
+	if err != nil {
+		return
+	}
+	res, err := es.ClosePointInTime(
+		es.ClosePointInTime.WithBody(body),
+		es.ClosePointInTime.WithContext(context.Background()),
+	)
+	if err != nil {
+		log.Printf("Failed to close point in time: %v", err)
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		log.Printf("Failed to close point in time: %v", NewElasticsearchError(res))
+	}
+}
+
+// clearScroll releases a scroll; failures only log since it expires anyway
+func clearScroll(es *elasticsearch.Client, scrollID string) {
+	if scrollID == "" {
+		return
+	}
+	res, err := es.ClearScroll(
+		es.ClearScroll.WithScrollID(scrollID),
+		es.ClearScroll.WithContext(context.Background()),
+	)
+	if err != nil {
+		log.Printf("Failed to clear scroll: %v", err)
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		log.Printf("Failed to clear scroll: %v", NewElasticsearchError(res))
+	}
+}
+
+// keepAlive formats a duration in the time unit syntax of Elasticsearch
+func keepAlive(d time.Duration) string {
+	if d%time.Second != 0 {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%ds", int64(d/time.Second))
+}
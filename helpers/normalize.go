@@ -0,0 +1,264 @@
+package helpers
+
+import (
+	"encoding"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHadi/AmanahPro-common/models"
+)
+
+// normalizeKind is what a JSON value has to be converted to for a target type
+type normalizeKind int
+
+const (
+	normalizeNone normalizeKind = iota // Leave the value as is
+	normalizeNumber
+	normalizeString
+	normalizeTime
+	normalizeDate
+	normalizeStruct
+	normalizeSlice
+	normalizeMap
+)
+
+// normalizePlan describes how to convert a decoded _source value for one Go type
+type normalizePlan struct {
+	kind   normalizeKind
+	elem   *normalizePlan            // Slice and map elements
+	fields map[string]*normalizePlan // Struct fields by JSON name
+	folded map[string]*normalizePlan // Struct fields by lower-case JSON name, as encoding/json matches them
+}
+
+var (
+	normalizePlans sync.Map // reflect.Type -> *normalizePlan
+
+	timeType        = reflect.TypeOf(time.Time{})
+	customDateType  = reflect.TypeOf(models.CustomDate{})
+	jsonNumberType  = reflect.TypeOf(json.Number(""))
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textType        = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// normalizeFor converts the values of a decoded _source to what the fields of T expect:
+// numeric strings for numeric fields, numbers for string fields, and date formats for
+// time.Time and models.CustomDate. Values for other fields are left untouched.
+func normalizeFor[T any](source map[string]interface{}) {
+	plan := planFor(reflect.TypeOf((*T)(nil)).Elem())
+	if plan.kind == normalizeStruct || plan.kind == normalizeMap {
+		normalizeObject(source, plan)
+	}
+}
+
+// planFor returns the cached plan of a type, building it on first use
+func planFor(t reflect.Type) *normalizePlan {
+	if plan, exists := normalizePlans.Load(t); exists {
+		return plan.(*normalizePlan)
+	}
+	plan := buildPlan(t, make(map[reflect.Type]*normalizePlan))
+	actual, _ := normalizePlans.LoadOrStore(t, plan)
+	return actual.(*normalizePlan)
+}
+
+// buildPlan builds the plan of a type; building tracks types in progress so recursive types terminate
+func buildPlan(t reflect.Type, building map[reflect.Type]*normalizePlan) *normalizePlan {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if plan, exists := building[t]; exists {
+		return plan
+	}
+
+	switch {
+	case t == timeType:
+		return &normalizePlan{kind: normalizeTime}
+	case t == customDateType:
+		return &normalizePlan{kind: normalizeDate}
+	case t == jsonNumberType:
+		return &normalizePlan{kind: normalizeNumber}
+	case reflect.PointerTo(t).Implements(unmarshalerType), reflect.PointerTo(t).Implements(textType):
+		return &normalizePlan{kind: normalizeNone} // Custom decoding
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return &normalizePlan{kind: normalizeNumber}
+	case reflect.String:
+		return &normalizePlan{kind: normalizeString}
+	case reflect.Slice, reflect.Array:
+		plan := &normalizePlan{kind: normalizeSlice}
+		building[t] = plan
+		plan.elem = buildPlan(t.Elem(), building)
+		return plan
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return &normalizePlan{kind: normalizeNone}
+		}
+		plan := &normalizePlan{kind: normalizeMap}
+		building[t] = plan
+		plan.elem = buildPlan(t.Elem(), building)
+		return plan
+	case reflect.Struct:
+		plan := &normalizePlan{
+			kind:   normalizeStruct,
+			fields: make(map[string]*normalizePlan),
+			folded: make(map[string]*normalizePlan),
+		}
+		building[t] = plan
+		addStructFields(plan, t, building)
+		return plan
+	default:
+		return &normalizePlan{kind: normalizeNone}
+	}
+}
+
+// addStructFields adds the JSON fields of a struct, including those of embedded structs
+func addStructFields(plan *normalizePlan, t reflect.Type, building map[reflect.Type]*normalizePlan) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				addStructFields(plan, embedded, building)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		fieldPlan := buildPlan(field.Type, building)
+		if options == "string" && fieldPlan.kind == normalizeNumber {
+			fieldPlan = &normalizePlan{kind: normalizeString} // Number encoded as a JSON string
+		}
+		plan.fields[name] = fieldPlan
+		if _, exists := plan.folded[strings.ToLower(name)]; !exists {
+			plan.folded[strings.ToLower(name)] = fieldPlan
+		}
+	}
+}
+
+// normalizeObject converts the values of an object in place
+func normalizeObject(data map[string]interface{}, plan *normalizePlan) {
+	for key, value := range data {
+		var fieldPlan *normalizePlan
+		switch plan.kind {
+		case normalizeMap:
+			fieldPlan = plan.elem
+		case normalizeStruct:
+			var exists bool
+			if fieldPlan, exists = plan.fields[key]; !exists {
+				fieldPlan = plan.folded[strings.ToLower(key)]
+			}
+		}
+		if fieldPlan != nil {
+			data[key] = normalizeValue(value, fieldPlan)
+		}
+	}
+}
+
+// normalizeValue converts one value according to its plan
+func normalizeValue(value interface{}, plan *normalizePlan) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	switch plan.kind {
+	case normalizeNumber:
+		if s, ok := value.(string); ok {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				return nil // Leave the field at its zero value
+			}
+			if number, ok := parseNumber(s); ok {
+				return number
+			}
+		}
+	case normalizeString:
+		switch v := value.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case json.Number:
+			return v.String()
+		case bool:
+			return strconv.FormatBool(v)
+		}
+	case normalizeTime:
+		if t, ok := parseSourceTime(value); ok {
+			return t.Format(time.RFC3339Nano)
+		}
+	case normalizeDate:
+		if t, ok := parseSourceTime(value); ok {
+			return t.Format("2006-01-02")
+		}
+	case normalizeStruct, normalizeMap:
+		if m, ok := value.(map[string]interface{}); ok {
+			normalizeObject(m, plan)
+		}
+	case normalizeSlice:
+		if items, ok := value.([]interface{}); ok {
+			for i, item := range items {
+				items[i] = normalizeValue(item, plan.elem)
+			}
+		}
+	}
+	return value
+}
+
+// parseNumber converts a numeric string into a JSON number. Valid JSON numbers are kept as they are,
+// so large integers keep their precision; other forms such as "00012", ".5" or "+5" are formatted canonically.
+func parseNumber(s string) (json.Number, bool) {
+	if (s[0] == '-' || (s[0] >= '0' && s[0] <= '9')) && json.Valid([]byte(s)) {
+		return json.Number(s), true
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return json.Number(strconv.FormatInt(i, 10)), true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", false
+	}
+	return json.Number(strconv.FormatFloat(f, 'f', -1, 64)), true
+}
+
+// parseSourceTime parses the date formats Elasticsearch returns: epoch milliseconds,
+// RFC3339, date-time without zone, or date only
+func parseSourceTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case float64:
+		return time.UnixMilli(int64(v)).UTC(), true
+	case json.Number:
+		if ms, err := v.Int64(); err == nil {
+			return time.UnixMilli(ms).UTC(), true
+		}
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.UnixMilli(ms).UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
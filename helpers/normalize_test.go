@@ -0,0 +1,63 @@
+package helpers
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNormalizeNumberString(t *testing.T) {
+	plan := &normalizePlan{kind: normalizeNumber}
+
+	tests := []struct {
+		input string
+		want  interface{}
+	}{
+		{"12", json.Number("12")},
+		{"-3.25", json.Number("-3.25")},
+		{"1e3", json.Number("1e3")},
+		{"12345678901234567890", json.Number("12345678901234567890")},
+		{" 42 ", json.Number("42")},
+		{"00012", json.Number("12")},
+		{"+5", json.Number("5")},
+		{".5", json.Number("0.5")},
+		{"1.", json.Number("1")},
+		{"-.5", json.Number("-0.5")},
+		{"", nil},
+		{"NaN", "NaN"},
+		{"Inf", "Inf"},
+		{"abc", "abc"},
+	}
+
+	for _, tt := range tests {
+		got := normalizeValue(tt.input, plan)
+		if got != tt.want {
+			t.Errorf("normalizeValue(%q) = %#v, want %#v", tt.input, got, tt.want)
+			continue
+		}
+		if _, err := json.Marshal(got); err != nil {
+			t.Errorf("normalizeValue(%q) = %#v does not marshal: %v", tt.input, got, err)
+		}
+	}
+}
+
+func TestNormalizeForDecodesNumericStrings(t *testing.T) {
+	type document struct {
+		Count int     `json:"count"`
+		Price float64 `json:"price"`
+	}
+
+	source := map[string]interface{}{"count": "00012", "price": ".5"}
+	normalizeFor[document](source)
+
+	data, err := json.Marshal(source)
+	if err != nil {
+		t.Fatalf("failed to marshal normalized source: %v", err)
+	}
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("failed to decode normalized source: %v", err)
+	}
+	if doc.Count != 12 || doc.Price != 0.5 {
+		t.Errorf("decoded %+v, want count 12 and price 0.5", doc)
+	}
+}
@@ -0,0 +1,395 @@
+package helpers
+
+import (
+	"bytes"
+)
+
+// Query is a clause of the Elasticsearch query DSL
+type Query interface {
+	Source() map[string]interface{}
+}
+
+// RawQuery is a hand-built clause, for DSL features the builder does not cover
+type RawQuery map[string]interface{}
+
+// Source returns the clause as a map
+func (q RawQuery) Source() map[string]interface{} {
+	return q
+}
+
+// MatchAll matches every document
+func MatchAll() Query {
+	return RawQuery{"match_all": map[string]interface{}{}}
+}
+
+// Term matches documents whose field equals value exactly
+func Term(field string, value interface{}) Query {
+	return RawQuery{"term": map[string]interface{}{field: value}}
+}
+
+// Terms matches documents whose field equals any of values
+func Terms(field string, values ...interface{}) Query {
+	return RawQuery{"terms": map[string]interface{}{field: values}}
+}
+
+// Match runs a full-text match on field
+func Match(field string, text interface{}) Query {
+	return RawQuery{"match": map[string]interface{}{field: text}}
+}
+
+// Prefix matches documents whose field starts with prefix
+func Prefix(field, prefix string) Query {
+	return RawQuery{"prefix": map[string]interface{}{field: prefix}}
+}
+
+// Exists matches documents that have a value for field
+func Exists(field string) Query {
+	return RawQuery{"exists": map[string]interface{}{"field": field}}
+}
+
+// Nested runs query against the nested objects at path
+func Nested(path string, query Query) Query {
+	return RawQuery{"nested": map[string]interface{}{
+		"path":  path,
+		"query": query.Source(),
+	}}
+}
+
+// RangeQuery matches documents whose field lies within bounds
+type RangeQuery struct {
+	field  string
+	params map[string]interface{}
+}
+
+// Range starts a range query on field
+func Range(field string) *RangeQuery {
+	return &RangeQuery{field: field, params: make(map[string]interface{})}
+}
+
+// Gt sets an exclusive lower bound
+func (q *RangeQuery) Gt(value interface{}) *RangeQuery {
+	q.params["gt"] = value
+	return q
+}
+
+// Gte sets an inclusive lower bound
+func (q *RangeQuery) Gte(value interface{}) *RangeQuery {
+	q.params["gte"] = value
+	return q
+}
+
+// Lt sets an exclusive upper bound
+func (q *RangeQuery) Lt(value interface{}) *RangeQuery {
+	q.params["lt"] = value
+	return q
+}
+
+// Lte sets an inclusive upper bound
+func (q *RangeQuery) Lte(value interface{}) *RangeQuery {
+	q.params["lte"] = value
+	return q
+}
+
+// Format sets the date format of the bounds
+func (q *RangeQuery) Format(format string) *RangeQuery {
+	q.params["format"] = format
+	return q
+}
+
+// Source returns the clause as a map
+func (q *RangeQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"range": map[string]interface{}{q.field: q.params}}
+}
+
+// BoolQuery combines clauses with must, filter, should and must_not
+type BoolQuery struct {
+	must               []Query
+	filter             []Query
+	should             []Query
+	mustNot            []Query
+	minimumShouldMatch interface{}
+}
+
+// Bool starts an empty bool query
+func Bool() *BoolQuery {
+	return &BoolQuery{}
+}
+
+// Must adds scoring clauses that have to match
+func (q *BoolQuery) Must(queries ...Query) *BoolQuery {
+	q.must = append(q.must, queries...)
+	return q
+}
+
+// Filter adds non-scoring clauses that have to match
+func (q *BoolQuery) Filter(queries ...Query) *BoolQuery {
+	q.filter = append(q.filter, queries...)
+	return q
+}
+
+// Should adds optional clauses that increase the score
+func (q *BoolQuery) Should(queries ...Query) *BoolQuery {
+	q.should = append(q.should, queries...)
+	return q
+}
+
+// MustNot adds clauses that must not match
+func (q *BoolQuery) MustNot(queries ...Query) *BoolQuery {
+	q.mustNot = append(q.mustNot, queries...)
+	return q
+}
+
+// MinimumShouldMatch sets how many should clauses have to match, e.g. 1 or "75%"
+func (q *BoolQuery) MinimumShouldMatch(value interface{}) *BoolQuery {
+	q.minimumShouldMatch = value
+	return q
+}
+
+// Source returns the clause as a map
+func (q *BoolQuery) Source() map[string]interface{} {
+	body := map[string]interface{}{}
+	addClauses(body, "must", q.must)
+	addClauses(body, "filter", q.filter)
+	addClauses(body, "should", q.should)
+	addClauses(body, "must_not", q.mustNot)
+	if q.minimumShouldMatch != nil {
+		body["minimum_should_match"] = q.minimumShouldMatch
+	}
+	return map[string]interface{}{"bool": body}
+}
+
+func addClauses(body map[string]interface{}, occur string, queries []Query) {
+	if len(queries) == 0 {
+		return
+	}
+	clauses := make([]interface{}, 0, len(queries))
+	for _, query := range queries {
+		clauses = append(clauses, query.Source())
+	}
+	body[occur] = clauses
+}
+
+// TenantFilter matches the documents of an organization
+func TenantFilter(tenancy Tenancy, organizationID int) Query {
+	return RawQuery(tenancy.Filter(organizationID))
+}
+
+// NotDeleted excludes soft-deleted documents, i.e. those with a value in field (default "deleted_at")
+func NotDeleted(field string) Query {
+	if field == "" {
+		field = "deleted_at"
+	}
+	return Bool().MustNot(Exists(field))
+}
+
+// Aggregation is an aggregation with optional sub-aggregations
+type Aggregation struct {
+	kind   string
+	params map[string]interface{}
+	subs   map[string]*Aggregation
+}
+
+// NewAggregation creates an aggregation of any kind, e.g. NewAggregation("percentiles", params)
+func NewAggregation(kind string, params map[string]interface{}) *Aggregation {
+	return &Aggregation{kind: kind, params: params}
+}
+
+// TermsAggregation buckets documents by the values of field
+func TermsAggregation(field string, size int) *Aggregation {
+	params := map[string]interface{}{"field": field}
+	if size > 0 {
+		params["size"] = size
+	}
+	return NewAggregation("terms", params)
+}
+
+// DateHistogramAggregation buckets documents by calendar interval, e.g. "month"
+func DateHistogramAggregation(field, interval string) *Aggregation {
+	return NewAggregation("date_histogram", map[string]interface{}{
+		"field":             field,
+		"calendar_interval": interval,
+	})
+}
+
+// SumAggregation sums field
+func SumAggregation(field string) *Aggregation {
+	return NewAggregation("sum", map[string]interface{}{"field": field})
+}
+
+// AvgAggregation averages field
+func AvgAggregation(field string) *Aggregation {
+	return NewAggregation("avg", map[string]interface{}{"field": field})
+}
+
+// MinAggregation returns the minimum of field
+func MinAggregation(field string) *Aggregation {
+	return NewAggregation("min", map[string]interface{}{"field": field})
+}
+
+// MaxAggregation returns the maximum of field
+func MaxAggregation(field string) *Aggregation {
+	return NewAggregation("max", map[string]interface{}{"field": field})
+}
+
+// CardinalityAggregation counts the distinct values of field
+func CardinalityAggregation(field string) *Aggregation {
+	return NewAggregation("cardinality", map[string]interface{}{"field": field})
+}
+
+// SubAggregation adds an aggregation computed per bucket
+func (a *Aggregation) SubAggregation(name string, sub *Aggregation) *Aggregation {
+	if a.subs == nil {
+		a.subs = make(map[string]*Aggregation)
+	}
+	a.subs[name] = sub
+	return a
+}
+
+// Source returns the aggregation as a map
+func (a *Aggregation) Source() map[string]interface{} {
+	body := map[string]interface{}{a.kind: a.params}
+	if len(a.subs) > 0 {
+		subs := make(map[string]interface{}, len(a.subs))
+		for name, sub := range a.subs {
+			subs[name] = sub.Source()
+		}
+		body["aggs"] = subs
+	}
+	return body
+}
+
+// SearchBuilder builds a search request body
+type SearchBuilder struct {
+	query        Query
+	scopes       []Query
+	sort         []interface{}
+	from         *int
+	size         *int
+	aggregations map[string]*Aggregation
+	highlight    []string
+	source       []string
+	trackTotal   bool
+}
+
+// NewSearch starts a search matching all documents
+func NewSearch() *SearchBuilder {
+	return &SearchBuilder{}
+}
+
+// Query sets the main query
+func (b *SearchBuilder) Query(query Query) *SearchBuilder {
+	b.query = query
+	return b
+}
+
+// Scope adds filters applied around the main query, e.g. TenantFilter and NotDeleted
+func (b *SearchBuilder) Scope(filters ...Query) *SearchBuilder {
+	b.scopes = append(b.scopes, filters...)
+	return b
+}
+
+// Sort adds a sort on field; order is "asc" or "desc"
+func (b *SearchBuilder) Sort(field, order string) *SearchBuilder {
+	b.sort = append(b.sort, map[string]interface{}{field: map[string]interface{}{"order": order}})
+	return b
+}
+
+// From sets the offset of the first hit
+func (b *SearchBuilder) From(from int) *SearchBuilder {
+	b.from = &from
+	return b
+}
+
+// Size sets the number of hits returned
+func (b *SearchBuilder) Size(size int) *SearchBuilder {
+	b.size = &size
+	return b
+}
+
+// Page sets from and size for a 1-based page number
+func (b *SearchBuilder) Page(page, perPage int) *SearchBuilder {
+	if page < 1 {
+		page = 1
+	}
+	return b.From((page - 1) * perPage).Size(perPage)
+}
+
+// Aggregation adds a named aggregation
+func (b *SearchBuilder) Aggregation(name string, aggregation *Aggregation) *SearchBuilder {
+	if b.aggregations == nil {
+		b.aggregations = make(map[string]*Aggregation)
+	}
+	b.aggregations[name] = aggregation
+	return b
+}
+
+// Highlight requests highlighted fragments for fields
+func (b *SearchBuilder) Highlight(fields ...string) *SearchBuilder {
+	b.highlight = append(b.highlight, fields...)
+	return b
+}
+
+// SourceFields limits the returned _source to fields
+func (b *SearchBuilder) SourceFields(fields ...string) *SearchBuilder {
+	b.source = append(b.source, fields...)
+	return b
+}
+
+// TrackTotalHits counts all matching documents instead of stopping at 10,000
+func (b *SearchBuilder) TrackTotalHits() *SearchBuilder {
+	b.trackTotal = true
+	return b
+}
+
+// Build returns the request body as a map, in the form accepted by MapToReader
+func (b *SearchBuilder) Build() map[string]interface{} {
+	body := map[string]interface{}{}
+
+	query := b.query
+	if len(b.scopes) > 0 {
+		scoped := Bool().Filter(b.scopes...)
+		if query != nil {
+			scoped.Must(query)
+		}
+		query = scoped
+	}
+	if query != nil {
+		body["query"] = query.Source()
+	}
+
+	if len(b.sort) > 0 {
+		body["sort"] = b.sort
+	}
+	if b.from != nil {
+		body["from"] = *b.from
+	}
+	if b.size != nil {
+		body["size"] = *b.size
+	}
+	if len(b.aggregations) > 0 {
+		aggs := make(map[string]interface{}, len(b.aggregations))
+		for name, aggregation := range b.aggregations {
+			aggs[name] = aggregation.Source()
+		}
+		body["aggs"] = aggs
+	}
+	if len(b.highlight) > 0 {
+		fields := make(map[string]interface{}, len(b.highlight))
+		for _, field := range b.highlight {
+			fields[field] = map[string]interface{}{}
+		}
+		body["highlight"] = map[string]interface{}{"fields": fields}
+	}
+	if len(b.source) > 0 {
+		body["_source"] = b.source
+	}
+	if b.trackTotal {
+		body["track_total_hits"] = true
+	}
+	return body
+}
+
+// Reader returns the request body as a JSON reader for Elasticsearch
+func (b *SearchBuilder) Reader() (*bytes.Reader, error) {
+	return MapToReader(b.Build())
+}
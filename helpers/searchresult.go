@@ -0,0 +1,280 @@
+package helpers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// SearchHit is one hit of a search response
+type SearchHit[T any] struct {
+	Index     string
+	ID        string
+	Score     *float64
+	Sort      []interface{}
+	Highlight map[string][]string
+	Source    T
+}
+
+// SearchResult is a decoded search response
+type SearchResult[T any] struct {
+	Took          int
+	TimedOut      bool
+	Total         int64
+	TotalRelation string // "eq", or "gte" when the total is a lower bound
+	MaxScore      *float64
+	Hits          []SearchHit[T]
+	Aggregations  map[string]json.RawMessage
+	ScrollID      string
+	PitID         string
+	DecodeErrors  []*HitDecodeError // Hits whose _source could not be decoded into T; they are left out of Hits
+}
+
+// HitDecodeError reports a hit whose _source could not be decoded
+type HitDecodeError struct {
+	Index string
+	ID    string
+	Err   error
+}
+
+func (e *HitDecodeError) Error() string {
+	return fmt.Sprintf("failed to decode hit %s/%s: %v", e.Index, e.ID, e.Err)
+}
+
+func (e *HitDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// ElasticsearchError is an error response from Elasticsearch
+type ElasticsearchError struct {
+	Status    int
+	Type      string
+	Reason    string
+	RootCause []ErrorCause
+	Body      string // Raw response body, for errors that are not in the standard format
+}
+
+// ErrorCause is a root cause of an Elasticsearch error
+type ErrorCause struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+	Index  string `json:"index,omitempty"`
+}
+
+func (e *ElasticsearchError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("elasticsearch error %d: %s", e.Status, e.Body)
+	}
+	return fmt.Sprintf("elasticsearch error %d: %s: %s", e.Status, e.Type, e.Reason)
+}
+
+// NewElasticsearchError reads the body of an error response into an ElasticsearchError
+func NewElasticsearchError(res *esapi.Response) *ElasticsearchError {
+	body, _ := io.ReadAll(res.Body)
+	esErr := &ElasticsearchError{
+		Status: res.StatusCode,
+		Body:   strings.TrimSpace(string(body)),
+	}
+
+	var envelope struct {
+		Error struct {
+			Type      string       `json:"type"`
+			Reason    string       `json:"reason"`
+			RootCause []ErrorCause `json:"root_cause"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err == nil {
+		esErr.Type = envelope.Error.Type
+		esErr.Reason = envelope.Error.Reason
+		esErr.RootCause = envelope.Error.RootCause
+	}
+	return esErr
+}
+
+// ParseSearchResult decodes a search response into a SearchResult. Error responses are returned
+// as *ElasticsearchError; hits that fail to decode are collected in DecodeErrors.
+func ParseSearchResult[T any](res *esapi.Response) (*SearchResult[T], error) {
+	if res.IsError() {
+		return nil, NewElasticsearchError(res)
+	}
+
+	var response struct {
+		Took     int    `json:"took"`
+		TimedOut bool   `json:"timed_out"`
+		ScrollID string `json:"_scroll_id"`
+		PitID    string `json:"pit_id"`
+		Hits     struct {
+			Total *struct {
+				Value    int64  `json:"value"`
+				Relation string `json:"relation"`
+			} `json:"total"`
+			MaxScore *float64 `json:"max_score"`
+			Hits     []struct {
+				Index     string                 `json:"_index"`
+				ID        string                 `json:"_id"`
+				Score     *float64               `json:"_score"`
+				Sort      []interface{}          `json:"sort"`
+				Highlight map[string][]string    `json:"highlight"`
+				Source    map[string]interface{} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+		Aggregations map[string]json.RawMessage `json:"aggregations"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode response body: %w", err)
+	}
+
+	result := &SearchResult[T]{
+		Took:         response.Took,
+		TimedOut:     response.TimedOut,
+		MaxScore:     response.Hits.MaxScore,
+		Aggregations: response.Aggregations,
+		ScrollID:     response.ScrollID,
+		PitID:        response.PitID,
+		Hits:         make([]SearchHit[T], 0, len(response.Hits.Hits)),
+	}
+	if response.Hits.Total != nil {
+		result.Total = response.Hits.Total.Value
+		result.TotalRelation = response.Hits.Total.Relation
+	}
+
+	for _, hit := range response.Hits.Hits {
+		source, err := decodeSource[T](hit.Source)
+		if err != nil {
+			result.DecodeErrors = append(result.DecodeErrors, &HitDecodeError{Index: hit.Index, ID: hit.ID, Err: err})
+			continue
+		}
+		result.Hits = append(result.Hits, SearchHit[T]{
+			Index:     hit.Index,
+			ID:        hit.ID,
+			Score:     hit.Score,
+			Sort:      hit.Sort,
+			Highlight: hit.Highlight,
+			Source:    source,
+		})
+	}
+
+	return result, nil
+}
+
+// decodeSource normalizes a hit _source and decodes it into T
+func decodeSource[T any](source map[string]interface{}) (T, error) {
+	var item T
+
+	// Normalize fields to the types of T before unmarshalling
+	normalizeFor[T](source)
+
+	data, err := json.Marshal(source)
+	if err != nil {
+		return item, fmt.Errorf("failed to marshal normalized data: %w", err)
+	}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return item, err
+	}
+	return item, nil
+}
+
+// Items returns the decoded sources of the hits
+func (r *SearchResult[T]) Items() []T {
+	items := make([]T, 0, len(r.Hits))
+	for _, hit := range r.Hits {
+		items = append(items, hit.Source)
+	}
+	return items
+}
+
+// IDs returns the document IDs of the hits
+func (r *SearchResult[T]) IDs() []string {
+	ids := make([]string, 0, len(r.Hits))
+	for _, hit := range r.Hits {
+		ids = append(ids, hit.ID)
+	}
+	return ids
+}
+
+// LastSort returns the sort values of the last hit, to pass as search_after for the next page
+func (r *SearchResult[T]) LastSort() []interface{} {
+	if len(r.Hits) == 0 {
+		return nil
+	}
+	return r.Hits[len(r.Hits)-1].Sort
+}
+
+// Err returns the collected decode errors as one error, or nil
+func (r *SearchResult[T]) Err() error {
+	if len(r.DecodeErrors) == 0 {
+		return nil
+	}
+	errs := make([]error, 0, len(r.DecodeErrors))
+	for _, err := range r.DecodeErrors {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// DecodeAggregation decodes a named aggregation into A, e.g. BucketAggregationResult
+func DecodeAggregation[A any, T any](result *SearchResult[T], name string) (A, error) {
+	var aggregation A
+	raw, exists := result.Aggregations[name]
+	if !exists {
+		return aggregation, fmt.Errorf("aggregation %s not found in response", name)
+	}
+	if err := json.Unmarshal(raw, &aggregation); err != nil {
+		return aggregation, fmt.Errorf("failed to decode aggregation %s: %w", name, err)
+	}
+	return aggregation, nil
+}
+
+// AggregationBucket is a bucket of a terms, histogram or date histogram aggregation.
+// Sub-aggregations are kept raw in Aggregations.
+type AggregationBucket struct {
+	Key          interface{}                `json:"key"`
+	KeyAsString  string                     `json:"key_as_string,omitempty"`
+	DocCount     int64                      `json:"doc_count"`
+	Aggregations map[string]json.RawMessage `json:"-"`
+}
+
+// UnmarshalJSON keeps the sub-aggregations of a bucket
+func (b *AggregationBucket) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	type plain AggregationBucket
+	var bucket plain
+	if err := json.Unmarshal(data, &bucket); err != nil {
+		return err
+	}
+	*b = AggregationBucket(bucket)
+
+	for name, raw := range fields {
+		switch name {
+		case "key", "key_as_string", "doc_count":
+			continue
+		}
+		if b.Aggregations == nil {
+			b.Aggregations = make(map[string]json.RawMessage)
+		}
+		b.Aggregations[name] = raw
+	}
+	return nil
+}
+
+// BucketAggregationResult is the result of a bucket aggregation such as terms or date_histogram
+type BucketAggregationResult struct {
+	DocCountErrorUpperBound int64               `json:"doc_count_error_upper_bound"`
+	SumOtherDocCount        int64               `json:"sum_other_doc_count"`
+	Buckets                 []AggregationBucket `json:"buckets"`
+}
+
+// MetricAggregationResult is the result of a single-value metric such as sum, avg or cardinality
+type MetricAggregationResult struct {
+	Value         *float64 `json:"value"`
+	ValueAsString string   `json:"value_as_string,omitempty"`
+}
@@ -0,0 +1,186 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	jwtModels "github.com/NHadi/AmanahPro-common/models"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/gin-gonic/gin"
+)
+
+// TenancyMode selects how documents of different organizations are separated
+type TenancyMode int
+
+const (
+	// TenancyNone keeps all organizations in the base index
+	TenancyNone TenancyMode = iota
+	// TenancyIndexPerOrganization writes each organization to its own index (or alias), e.g. "sph-org-12"
+	TenancyIndexPerOrganization
+	// TenancyFilteredAlias keeps one shared index and gives each organization a filtered alias
+	// that routes on the organization ID, e.g. alias "sph-org-12" on index "sph"
+	TenancyFilteredAlias
+)
+
+// ErrNoOrganization is returned when a tenant-scoped operation has no organization
+var ErrNoOrganization = errors.New("no organization for tenant-scoped request")
+
+// Tenancy configures tenant routing; the zero value disables it
+type Tenancy struct {
+	Mode       TenancyMode
+	Field      string // Document field holding the organization ID, default "organization_id"
+	NameFormat string // Index or alias name from base index and organization ID, default "%s-org-%d"
+}
+
+// Enabled reports whether documents are routed by organization
+func (t Tenancy) Enabled() bool {
+	return t.Mode != TenancyNone
+}
+
+// OrganizationField returns the document field holding the organization ID
+func (t Tenancy) OrganizationField() string {
+	if t.Field == "" {
+		return "organization_id"
+	}
+	return t.Field
+}
+
+// IndexName returns the index or alias an organization reads and writes
+func (t Tenancy) IndexName(base string, organizationID int) string {
+	if !t.Enabled() {
+		return base
+	}
+	format := t.NameFormat
+	if format == "" {
+		format = "%s-org-%d"
+	}
+	return fmt.Sprintf(format, base, organizationID)
+}
+
+// Routing returns the shard routing value of an organization; empty unless aliases are filtered
+func (t Tenancy) Routing(organizationID int) string {
+	if t.Mode != TenancyFilteredAlias {
+		return ""
+	}
+	return strconv.Itoa(organizationID)
+}
+
+// Filter returns the term filter matching the documents of an organization
+func (t Tenancy) Filter(organizationID int) map[string]interface{} {
+	return map[string]interface{}{
+		"term": map[string]interface{}{
+			t.OrganizationField(): organizationID,
+		},
+	}
+}
+
+// ScopeQuery adds the organization filter to a search body, so a query stays scoped
+// even when it is sent to the shared index. The body is not modified.
+func (t Tenancy) ScopeQuery(body map[string]interface{}, organizationID int) map[string]interface{} {
+	scoped := make(map[string]interface{}, len(body)+1)
+	for key, value := range body {
+		scoped[key] = value
+	}
+
+	boolQuery := map[string]interface{}{
+		"filter": []interface{}{t.Filter(organizationID)},
+	}
+	if query, exists := body["query"]; exists {
+		boolQuery["must"] = []interface{}{query}
+	}
+	scoped["query"] = map[string]interface{}{"bool": boolQuery}
+	return scoped
+}
+
+// EnsureAlias creates the filtered, routed alias of an organization on the base index.
+// Creating an alias that already exists is a no-op.
+func (t Tenancy) EnsureAlias(ctx context.Context, es *elasticsearch.Client, base string, organizationID int) error {
+	if t.Mode != TenancyFilteredAlias {
+		return nil
+	}
+
+	routing := t.Routing(organizationID)
+	body, err := MapToReader(map[string]interface{}{
+		"filter":  t.Filter(organizationID),
+		"routing": routing,
+	})
+	if err != nil {
+		return err
+	}
+
+	alias := t.IndexName(base, organizationID)
+	res, err := es.Indices.PutAlias(
+		[]string{base},
+		alias,
+		es.Indices.PutAlias.WithBody(body),
+		es.Indices.PutAlias.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create alias %s: %w", alias, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errBody, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("failed to create alias %s: %s: %s", alias, res.Status(), errBody)
+	}
+	return nil
+}
+
+// OrganizationFromContext returns the organization ID of the authenticated user.
+// Unlike GetClaims it does not write a response.
+func OrganizationFromContext(c *gin.Context) (int, error) {
+	userClaims, exists := c.Get("user")
+	if !exists {
+		return 0, fmt.Errorf("unauthorized")
+	}
+	claims, ok := userClaims.(*jwtModels.JWTClaims)
+	if !ok {
+		return 0, fmt.Errorf("invalid token claims")
+	}
+	if claims.OrganizationId == nil {
+		return 0, ErrNoOrganization
+	}
+	return *claims.OrganizationId, nil
+}
+
+// TenantSearch returns search options for the organization of the authenticated user:
+// its index or alias, its routing, and the query scoped with the organization filter.
+// With tenancy disabled it searches the base index with the query unchanged.
+func TenantSearch(c *gin.Context, es *elasticsearch.Client, tenancy Tenancy, base string, query map[string]interface{}) ([]func(*esapi.SearchRequest), error) {
+	if !tenancy.Enabled() {
+		body, err := MapToReader(query)
+		if err != nil {
+			return nil, err
+		}
+		return []func(*esapi.SearchRequest){
+			es.Search.WithIndex(base),
+			es.Search.WithBody(body),
+			es.Search.WithContext(c.Request.Context()),
+		}, nil
+	}
+
+	organizationID, err := OrganizationFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := MapToReader(tenancy.ScopeQuery(query, organizationID))
+	if err != nil {
+		return nil, err
+	}
+
+	options := []func(*esapi.SearchRequest){
+		es.Search.WithIndex(tenancy.IndexName(base, organizationID)),
+		es.Search.WithBody(body),
+		es.Search.WithContext(c.Request.Context()),
+	}
+	if routing := tenancy.Routing(organizationID); routing != "" {
+		options = append(options, es.Search.WithRouting(routing))
+	}
+	return options, nil
+}
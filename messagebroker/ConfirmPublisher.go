@@ -0,0 +1,114 @@
+package messagebroker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ConfirmPublisher publishes on a channel in confirm mode and waits for the broker to confirm
+// each message, so callers only ack the message they republished once it is safely stored.
+// Confirmations are matched to messages by delivery tag, so it must be the only publisher on
+// the channel; the channel may also be used for consuming.
+type ConfirmPublisher struct {
+	channel      *amqp.Channel
+	timeout      time.Duration
+	nextTag      uint64
+	publishMutex sync.Mutex // Keeps delivery tags in publish order
+	pending      map[uint64]chan bool
+	closed       bool
+	pendingMutex sync.Mutex
+}
+
+// NewConfirmPublisher puts a channel into confirm mode
+func NewConfirmPublisher(channel *amqp.Channel, timeout time.Duration) (*ConfirmPublisher, error) {
+	if err := channel.Confirm(false); err != nil {
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	publisher := &ConfirmPublisher{
+		channel: channel,
+		timeout: timeout,
+		pending: make(map[uint64]chan bool),
+	}
+	go publisher.dispatch(channel.NotifyPublish(make(chan amqp.Confirmation, 16)))
+	return publisher, nil
+}
+
+// Publish sends a message and waits until the broker confirms it or the timeout expires
+func (p *ConfirmPublisher) Publish(exchange, routingKey string, msg amqp.Publishing) error {
+	result, tag, err := p.send(exchange, routingKey, msg)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case ack, ok := <-result:
+		if !ok {
+			return fmt.Errorf("channel closed before broker confirmed message %s", msg.MessageId)
+		}
+		if !ack {
+			return fmt.Errorf("broker rejected message %s", msg.MessageId)
+		}
+		return nil
+	case <-timer.C:
+		p.pendingMutex.Lock()
+		delete(p.pending, tag) // A late confirmation is dropped
+		p.pendingMutex.Unlock()
+		return fmt.Errorf("timed out waiting for broker to confirm message %s", msg.MessageId)
+	}
+}
+
+// send publishes a message and registers for the confirmation of its delivery tag
+func (p *ConfirmPublisher) send(exchange, routingKey string, msg amqp.Publishing) (chan bool, uint64, error) {
+	p.publishMutex.Lock()
+	defer p.publishMutex.Unlock()
+
+	tag := p.nextTag + 1
+	result := make(chan bool, 1)
+
+	p.pendingMutex.Lock()
+	if p.closed {
+		p.pendingMutex.Unlock()
+		return nil, 0, errors.New("channel is closed")
+	}
+	p.pending[tag] = result
+	p.pendingMutex.Unlock()
+
+	if err := p.channel.Publish(exchange, routingKey, false, false, msg); err != nil {
+		p.pendingMutex.Lock()
+		delete(p.pending, tag)
+		p.pendingMutex.Unlock()
+		return nil, 0, err
+	}
+	p.nextTag = tag
+	return result, tag, nil
+}
+
+// dispatch hands each confirmation to the publisher waiting for its delivery tag
+func (p *ConfirmPublisher) dispatch(confirms chan amqp.Confirmation) {
+	for confirm := range confirms {
+		p.pendingMutex.Lock()
+		result, exists := p.pending[confirm.DeliveryTag]
+		delete(p.pending, confirm.DeliveryTag)
+		p.pendingMutex.Unlock()
+
+		if exists {
+			result <- confirm.Ack
+		}
+	}
+
+	// The channel was closed; fail every message still waiting
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+	p.closed = true
+	for tag, result := range p.pending {
+		close(result)
+		delete(p.pending, tag)
+	}
+}
@@ -0,0 +1,195 @@
+package messagebroker
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DeadLetter is a message that exhausted its retries
+type DeadLetter struct {
+	MessageID     string     `json:"messageId"`
+	OriginalQueue string     `json:"originalQueue"`
+	Attempts      int        `json:"attempts"`
+	Reason        string     `json:"reason"`
+	FailedAt      *time.Time `json:"failedAt,omitempty"`
+	Headers       amqp.Table `json:"headers"`
+	Body          []byte     `json:"body"`
+}
+
+// DeadLetterManager lists, inspects and replays the dead-letter queue of a queue
+type DeadLetterManager struct {
+	service   *RabbitMQService
+	queueName string
+}
+
+// NewDeadLetterManager creates a manager for the dead-letter queue of queueName
+func NewDeadLetterManager(service *RabbitMQService, queueName string) *DeadLetterManager {
+	return &DeadLetterManager{
+		service:   service,
+		queueName: queueName,
+	}
+}
+
+// List returns up to limit dead-lettered messages without removing them from the queue
+func (m *DeadLetterManager) List(limit int) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := m.walk(func(channel *deadLetterChannel, msg amqp.Delivery) (bool, error) {
+		letters = append(letters, toDeadLetter(msg))
+		return limit <= 0 || len(letters) < limit, nil
+	})
+	return letters, err
+}
+
+// Inspect returns the dead-lettered message with the given message ID
+func (m *DeadLetterManager) Inspect(messageID string) (*DeadLetter, error) {
+	var found *DeadLetter
+	err := m.walk(func(channel *deadLetterChannel, msg amqp.Delivery) (bool, error) {
+		if msg.MessageId != messageID {
+			return true, nil
+		}
+		letter := toDeadLetter(msg)
+		found = &letter
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("dead letter %s not found in %s", messageID, DeadLetterQueueName(m.queueName))
+	}
+	return found, nil
+}
+
+// Replay moves up to limit dead-lettered messages back to the original queue with a reset retry count
+func (m *DeadLetterManager) Replay(limit int) (int, error) {
+	replayed := 0
+	err := m.walk(func(channel *deadLetterChannel, msg amqp.Delivery) (bool, error) {
+		if err := m.replay(channel, msg); err != nil {
+			return false, err
+		}
+		replayed++
+		return limit <= 0 || replayed < limit, nil
+	})
+	if replayed > 0 {
+		log.Printf("Replayed %d dead-lettered messages to queue %s", replayed, m.queueName)
+	}
+	return replayed, err
+}
+
+// ReplayMessage moves a single dead-lettered message back to the original queue
+func (m *DeadLetterManager) ReplayMessage(messageID string) error {
+	found := false
+	err := m.walk(func(channel *deadLetterChannel, msg amqp.Delivery) (bool, error) {
+		if msg.MessageId != messageID {
+			return true, nil
+		}
+		found = true
+		return false, m.replay(channel, msg)
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("dead letter %s not found in %s", messageID, DeadLetterQueueName(m.queueName))
+	}
+	log.Printf("Replayed dead-lettered message %s to queue %s", messageID, m.queueName)
+	return nil
+}
+
+// deadLetterConfirmTimeout bounds how long a replay waits for the broker to confirm a message
+const deadLetterConfirmTimeout = 10 * time.Second
+
+// deadLetterChannel is a confirm-mode channel used while walking a dead-letter queue
+type deadLetterChannel struct {
+	*amqp.Channel
+	publisher *ConfirmPublisher
+}
+
+// walk fetches dead-lettered messages one by one on a dedicated channel until visit returns false.
+// Messages that are not acknowledged by visit return to the dead-letter queue when the channel closes.
+func (m *DeadLetterManager) walk(visit func(channel *deadLetterChannel, msg amqp.Delivery) (bool, error)) error {
+	amqpChannel, err := m.service.NewChannel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer amqpChannel.Close()
+
+	publisher, err := NewConfirmPublisher(amqpChannel, deadLetterConfirmTimeout)
+	if err != nil {
+		return err
+	}
+	channel := &deadLetterChannel{
+		Channel:   amqpChannel,
+		publisher: publisher,
+	}
+
+	dlq := DeadLetterQueueName(m.queueName)
+	for {
+		msg, ok, err := channel.Get(dlq, false)
+		if err != nil {
+			return fmt.Errorf("failed to read from %s: %w", dlq, err)
+		}
+		if !ok {
+			return nil // Queue drained
+		}
+		more, err := visit(channel, msg)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// replay republishes a dead-lettered message to the original queue and acks it once confirmed
+func (m *DeadLetterManager) replay(channel *deadLetterChannel, msg amqp.Delivery) error {
+	headers := amqp.Table{}
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	delete(headers, RetryCountHeader)
+	delete(headers, FailureReasonHeader)
+	delete(headers, FailedAtHeader)
+
+	err := channel.publisher.Publish(
+		"",
+		m.queueName,
+		amqp.Publishing{
+			Headers:       headers,
+			ContentType:   msg.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: msg.CorrelationId,
+			MessageId:     msg.MessageId,
+			Timestamp:     msg.Timestamp,
+			Type:          msg.Type,
+			Body:          msg.Body,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to replay message %s: %w", msg.MessageId, err)
+	}
+	return msg.Ack(false)
+}
+
+// toDeadLetter converts a delivery from the dead-letter queue
+func toDeadLetter(msg amqp.Delivery) DeadLetter {
+	letter := DeadLetter{
+		MessageID: msg.MessageId,
+		Attempts:  RetryAttempts(msg),
+		Headers:   msg.Headers,
+		Body:      msg.Body,
+	}
+	if queue, ok := msg.Headers[OriginalQueueHeader].(string); ok {
+		letter.OriginalQueue = queue
+	}
+	if reason, ok := msg.Headers[FailureReasonHeader].(string); ok {
+		letter.Reason = reason
+	}
+	if failedAt, ok := msg.Headers[FailedAtHeader].(string); ok {
+		if t, err := time.Parse(time.RFC3339, failedAt); err == nil {
+			letter.FailedAt = &t
+		}
+	}
+	return letter
+}
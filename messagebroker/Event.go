@@ -0,0 +1,126 @@
+package messagebroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/NHadi/AmanahPro-common/models"
+	"github.com/google/uuid"
+)
+
+// EventSchemaVersion is the current version of the Event envelope
+const EventSchemaVersion = 1
+
+// Event is the envelope shared by every AmanahPro service on the message bus.
+// The "event", "payload", "meta" and "timestamp" fields keep the format of the original
+// anonymous event struct, so older producers and consumers remain compatible.
+type Event struct {
+	ID             string                 `json:"id,omitempty"`
+	Type           string                 `json:"event"`
+	Resource       string                 `json:"resource,omitempty"`    // Aggregate name, e.g. "Sph" or "Project"
+	AggregateID    string                 `json:"aggregateId,omitempty"` // ID of the changed aggregate
+	OrganizationID *int                   `json:"organizationId,omitempty"`
+	TraceID        string                 `json:"traceId,omitempty"`
+	UserID         int                    `json:"userId,omitempty"`
+	SchemaVersion  int                    `json:"schemaVersion,omitempty"`
+	OccurredAt     time.Time              `json:"occurredAt"`
+	Payload        json.RawMessage        `json:"payload"`
+	Meta           map[string]interface{} `json:"meta,omitempty"`
+	Timestamp      string                 `json:"timestamp,omitempty"` // Legacy field, RFC3339
+}
+
+// NewEvent creates an envelope for a domain event with a new ID and the current time
+func NewEvent(eventType, resource string, aggregateID interface{}, payload interface{}) (*Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event payload: %w", err)
+	}
+
+	now := time.Now().UTC()
+	event := &Event{
+		ID:            uuid.NewString(),
+		Type:          eventType,
+		Resource:      resource,
+		SchemaVersion: EventSchemaVersion,
+		OccurredAt:    now,
+		Payload:       data,
+		Timestamp:     now.Format(time.RFC3339),
+	}
+	if aggregateID != nil {
+		event.AggregateID = fmt.Sprint(aggregateID)
+	}
+	return event, nil
+}
+
+// WithActor sets the trace ID, user and organization of the event from the request claims
+func (e *Event) WithActor(traceID string, claims *models.JWTClaims) *Event {
+	e.TraceID = traceID
+	if claims != nil {
+		e.UserID = claims.UserID
+		e.OrganizationID = claims.OrganizationId
+	}
+	return e
+}
+
+// WithMeta sets a metadata value, such as "idField"
+func (e *Event) WithMeta(key string, value interface{}) *Event {
+	if e.Meta == nil {
+		e.Meta = make(map[string]interface{})
+	}
+	e.Meta[key] = value
+	return e
+}
+
+// ParseEvent decodes an envelope from a message body and fills in defaults for legacy events
+func ParseEvent(body []byte) (*Event, error) {
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("failed to parse event: %w", err)
+	}
+	if event.Type == "" {
+		return nil, fmt.Errorf("event type is missing")
+	}
+
+	if event.SchemaVersion == 0 {
+		event.SchemaVersion = 1 // Events without a version predate the envelope
+	}
+	if event.SchemaVersion > EventSchemaVersion {
+		return nil, fmt.Errorf("unsupported event schema version %d (latest supported: %d)", event.SchemaVersion, EventSchemaVersion)
+	}
+	if event.Timestamp == "" {
+		event.Timestamp = time.Now().Format(time.RFC3339)
+	}
+	if event.OccurredAt.IsZero() {
+		if t, err := time.Parse(time.RFC3339, event.Timestamp); err == nil {
+			event.OccurredAt = t
+		}
+	}
+	if event.Meta == nil {
+		event.Meta = make(map[string]interface{})
+	}
+	return &event, nil
+}
+
+// DecodePayload decodes the event payload into T
+func DecodePayload[T any](event *Event) (T, error) {
+	var payload T
+	if len(event.Payload) == 0 {
+		return payload, fmt.Errorf("event %s has no payload", event.Type)
+	}
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return payload, fmt.Errorf("failed to decode payload of event %s: %w", event.Type, err)
+	}
+	return payload, nil
+}
+
+// DecodeEvent parses an envelope and decodes its payload into T
+func DecodeEvent[T any](body []byte) (*Event, T, error) {
+	event, err := ParseEvent(body)
+	if err != nil {
+		var zero T
+		return nil, zero, err
+	}
+	payload, err := DecodePayload[T](event)
+	return event, payload, err
+}
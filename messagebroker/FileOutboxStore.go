@@ -0,0 +1,169 @@
+package messagebroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileOutboxStore keeps unconfirmed messages as JSON files in a local directory.
+// It is intended for services without a database; the directory must be on persistent storage.
+type FileOutboxStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+// NewFileOutboxStore creates the outbox directory if needed and returns the store
+func NewFileOutboxStore(dir string) (*FileOutboxStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+	return &FileOutboxStore{dir: dir}, nil
+}
+
+// fileName builds a name that sorts by creation time. The ID is escaped so it cannot leave the directory.
+func (s *FileOutboxStore) fileName(msg OutboxMessage) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d-%s.json", msg.CreatedAt.UnixNano(), url.PathEscape(msg.ID)))
+}
+
+// findFile locates the file of a message by its exact ID
+func (s *FileOutboxStore) findFile(id string) (string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return "", err
+	}
+
+	suffix := url.PathEscape(id) + ".json"
+	for _, entry := range entries {
+		name := entry.Name()
+		// Names are "<20-digit timestamp>-<escaped ID>.json"
+		if len(name) > 21 && name[20] == '-' && name[21:] == suffix {
+			return filepath.Join(s.dir, name), nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// writeFile writes a message atomically through a temporary file
+func (s *FileOutboxStore) writeFile(path string, msg OutboxMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox message: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".outbox-*")
+	if err != nil {
+		return fmt.Errorf("failed to create outbox file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write outbox file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync outbox file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close outbox file: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readFile loads a message from disk
+func (s *FileOutboxStore) readFile(path string) (OutboxMessage, error) {
+	var msg OutboxMessage
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return msg, err
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, fmt.Errorf("failed to parse outbox file %s: %w", path, err)
+	}
+	return msg, nil
+}
+
+// Save writes a message to the outbox directory
+func (s *FileOutboxStore) Save(msg OutboxMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.writeFile(s.fileName(msg), msg)
+}
+
+// Pending returns the oldest unconfirmed messages
+func (s *FileOutboxStore) Pending(limit int) ([]OutboxMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox directory: %w", err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	var messages []OutboxMessage
+	for _, name := range names {
+		if limit > 0 && len(messages) >= limit {
+			break
+		}
+		msg, err := s.readFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// MarkFailed increments the attempt counter and stores the last error
+func (s *FileOutboxStore) MarkFailed(id string, reason error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path, err := s.findFile(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to find outbox file: %w", err)
+	}
+	msg, err := s.readFile(path)
+	if err != nil {
+		return err
+	}
+	msg.Attempts++
+	msg.LastError = truncateError(reason)
+	return s.writeFile(path, msg)
+}
+
+// Delete removes the file of a confirmed message
+func (s *FileOutboxStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path, err := s.findFile(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to find outbox file: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete outbox file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package messagebroker
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// GormOutboxStore keeps unconfirmed messages in a SQL table so they survive restarts.
+// Use it with the *gorm.DB returned by persistence.InitializeDB.
+type GormOutboxStore struct {
+	db *gorm.DB
+}
+
+// NewGormOutboxStore creates the outbox table if needed and returns the store
+func NewGormOutboxStore(db *gorm.DB) (*GormOutboxStore, error) {
+	if err := db.AutoMigrate(&OutboxMessage{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate outbox table: %w", err)
+	}
+	return &GormOutboxStore{db: db}, nil
+}
+
+// Save inserts a message into the outbox table
+func (s *GormOutboxStore) Save(msg OutboxMessage) error {
+	if err := s.db.Create(&msg).Error; err != nil {
+		return fmt.Errorf("failed to save outbox message: %w", err)
+	}
+	return nil
+}
+
+// SaveTx inserts a message into the outbox table using the given transaction, so it is only
+// published once the transaction commits
+func (s *GormOutboxStore) SaveTx(tx *gorm.DB, msg OutboxMessage) error {
+	if err := tx.Create(&msg).Error; err != nil {
+		return fmt.Errorf("failed to save outbox message: %w", err)
+	}
+	return nil
+}
+
+// Pending returns the oldest unconfirmed messages
+func (s *GormOutboxStore) Pending(limit int) ([]OutboxMessage, error) {
+	var messages []OutboxMessage
+	query := s.db.Order("created_at")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Find(&messages).Error; err != nil {
+		return nil, fmt.Errorf("failed to load pending outbox messages: %w", err)
+	}
+	return messages, nil
+}
+
+// MarkFailed increments the attempt counter and stores the last error
+func (s *GormOutboxStore) MarkFailed(id string, reason error) error {
+	err := s.db.Model(&OutboxMessage{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"attempts":   gorm.Expr("attempts + 1"),
+			"last_error": truncateError(reason),
+		}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update outbox message: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a confirmed message from the outbox table
+func (s *GormOutboxStore) Delete(id string) error {
+	if err := s.db.Delete(&OutboxMessage{}, "id = ?", id).Error; err != nil {
+		return fmt.Errorf("failed to delete outbox message: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package messagebroker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// maxResubscribeWait caps the backoff between re-subscription attempts
+const maxResubscribeWait = 30 * time.Second
+
+// ConsumerConfig describes a consumer registered with RabbitMQService.
+// The same queue, concurrency, prefetch and handler are used again after every reconnect.
+type ConsumerConfig struct {
+	QueueName   string
+	Concurrency int
+	Prefetch    int // Unacknowledged messages the broker may push to this consumer; defaults to Concurrency
+	AutoAck     bool
+	// Setup runs on the consumer channel before every (re)subscription, e.g. to declare retry queues
+	Setup func(channel *amqp.Channel) error
+	// Handler processes a delivery; channel is the channel the delivery arrived on
+	Handler func(channel *amqp.Channel, msg amqp.Delivery)
+	// PartitionKey, when set, routes deliveries with the same key to the same worker to keep their order
+	PartitionKey func(msg amqp.Delivery) string
+}
+
+// ManagedConsumer is a consumer that RabbitMQService re-subscribes after reconnecting.
+// Each managed consumer owns a dedicated channel, so a channel error on one consumer
+// does not affect publishers or other consumers.
+type ManagedConsumer struct {
+	service      *RabbitMQService
+	config       ConsumerConfig
+	channel      *amqp.Channel
+	subscription *Subscription
+	stopped      bool
+	done         chan struct{} // Closed when the consumer is stopped
+	mutex        sync.Mutex
+}
+
+// RegisterConsumer subscribes a consumer and keeps it registered so that it is transparently
+// re-subscribed after every reconnect. Cancelling ctx stops and unregisters the consumer.
+func (s *RabbitMQService) RegisterConsumer(ctx context.Context, config ConsumerConfig) (*ManagedConsumer, error) {
+	consumer := &ManagedConsumer{
+		service: s,
+		config:  config,
+		done:    make(chan struct{}),
+	}
+	if _, err := consumer.subscribe(nil); err != nil {
+		return nil, err
+	}
+
+	s.consumersMutex.Lock()
+	s.consumers = append(s.consumers, consumer)
+	s.consumersMutex.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			consumer.stop()
+		case <-consumer.done: // Stopped with Stop
+		}
+	}()
+
+	log.Printf("Consumer registered for queue: %s", config.QueueName)
+	return consumer, nil
+}
+
+// SetOnResubscribe sets a hook called after each consumer re-subscription attempt following a reconnect
+func (s *RabbitMQService) SetOnResubscribe(hook func(queueName string, err error)) {
+	s.consumersMutex.Lock()
+	defer s.consumersMutex.Unlock()
+	s.onResubscribe = hook
+}
+
+// Resubscriptions returns how many consumer re-subscriptions succeeded since startup
+func (s *RabbitMQService) Resubscriptions() int64 {
+	return s.resubscriptions.Load()
+}
+
+// resubscribeConsumers re-subscribes every registered consumer on the new connection,
+// retrying each one in the background until it succeeds
+func (s *RabbitMQService) resubscribeConsumers() {
+	s.consumersMutex.Lock()
+	consumers := append([]*ManagedConsumer(nil), s.consumers...)
+	s.consumersMutex.Unlock()
+
+	for _, consumer := range consumers {
+		go consumer.resubscribe(consumer.currentChannel())
+	}
+}
+
+// notifyResubscribe counts a re-subscription and calls the resubscribe hook
+func (s *RabbitMQService) notifyResubscribe(queueName string, err error) {
+	s.consumersMutex.Lock()
+	hook := s.onResubscribe
+	s.consumersMutex.Unlock()
+
+	if err == nil {
+		s.resubscriptions.Add(1)
+		log.Printf("Consumer re-subscribed to queue: %s", queueName)
+	}
+	if hook != nil {
+		hook(queueName, err)
+	}
+}
+
+// unregisterConsumer removes a consumer from the re-subscription list
+func (s *RabbitMQService) unregisterConsumer(consumer *ManagedConsumer) {
+	s.consumersMutex.Lock()
+	defer s.consumersMutex.Unlock()
+
+	for i, registered := range s.consumers {
+		if registered == consumer {
+			s.consumers = append(s.consumers[:i], s.consumers[i+1:]...)
+			return
+		}
+	}
+}
+
+// QueueName returns the consumed queue
+func (m *ManagedConsumer) QueueName() string {
+	return m.config.QueueName
+}
+
+// Subscription returns the current subscription; it changes after every reconnect
+func (m *ManagedConsumer) Subscription() *Subscription {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.subscription
+}
+
+// Done returns a channel that is closed when the consumer is stopped
+func (m *ManagedConsumer) Done() <-chan struct{} {
+	return m.done
+}
+
+// Stop unregisters the consumer, cancels it and waits for in-flight handlers until ctx expires
+func (m *ManagedConsumer) Stop(ctx context.Context) error {
+	subscription := m.stop()
+	if subscription == nil {
+		return nil
+	}
+	return subscription.Stop(ctx)
+}
+
+// stop unregisters the consumer and cancels the current subscription without waiting
+func (m *ManagedConsumer) stop() *Subscription {
+	m.service.unregisterConsumer(m)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.stopped {
+		m.stopped = true
+		close(m.done)
+	}
+	if m.subscription != nil {
+		m.subscription.cancel()
+		channel, subscription := m.channel, m.subscription
+		go func() {
+			// Close the dedicated channel once in-flight handlers have acked
+			<-subscription.Done()
+			_ = channel.Close()
+		}()
+	}
+	return m.subscription
+}
+
+// Prefetch returns the effective prefetch count of the consumer
+func (m *ManagedConsumer) Prefetch() int {
+	if m.config.Prefetch > 0 {
+		return m.config.Prefetch
+	}
+	if m.config.Concurrency > 0 {
+		return m.config.Concurrency
+	}
+	return 1
+}
+
+// currentChannel returns the channel of the current subscription
+func (m *ManagedConsumer) currentChannel() *amqp.Channel {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.channel
+}
+
+// subscribe opens a dedicated channel with the configured prefetch and starts a new subscription on it.
+// It replaces the subscription on previous only; when another goroutine already replaced it or the
+// consumer was stopped, it does nothing and reports false.
+func (m *ManagedConsumer) subscribe(previous *amqp.Channel) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.stopped || m.channel != previous {
+		return false, nil
+	}
+
+	channel, err := m.service.NewChannel()
+	if err != nil {
+		return false, fmt.Errorf("failed to open consumer channel for queue %s: %w", m.config.QueueName, err)
+	}
+	closed := channel.NotifyClose(make(chan *amqp.Error, 1))
+	if err := channel.Qos(m.Prefetch(), 0, false); err != nil {
+		_ = channel.Close()
+		return false, fmt.Errorf("failed to set prefetch for queue %s: %w", m.config.QueueName, err)
+	}
+	if m.config.Setup != nil {
+		if err := m.config.Setup(channel); err != nil {
+			_ = channel.Close()
+			return false, fmt.Errorf("failed to set up consumer for queue %s: %w", m.config.QueueName, err)
+		}
+	}
+
+	handler := m.config.Handler
+	subscription, err := SubscribeOrdered(context.Background(), channel, m.config.QueueName, m.config.Concurrency, m.config.AutoAck, m.config.PartitionKey, func(msg amqp.Delivery) {
+		handler(channel, msg)
+	})
+	if err != nil {
+		_ = channel.Close()
+		return false, err
+	}
+
+	if m.channel != nil {
+		_ = m.channel.Close() // Release the channel of the previous connection
+	}
+	m.channel = channel
+	m.subscription = subscription
+
+	go m.watchChannel(channel, closed)
+	return true, nil
+}
+
+// watchChannel re-subscribes the consumer when its channel is closed by a channel-level error
+// while the connection stays up. Connection losses are handled by the service reconnect.
+func (m *ManagedConsumer) watchChannel(channel *amqp.Channel, closed chan *amqp.Error) {
+	amqpErr := <-closed
+	if amqpErr == nil {
+		return // Closed on purpose
+	}
+	if m.service.isConnectionClosed() {
+		return
+	}
+
+	log.Printf("Consumer channel for queue %s closed: %v. Re-subscribing...", m.config.QueueName, amqpErr)
+	m.resubscribe(channel)
+}
+
+// resubscribe replaces the subscription on previous, retrying with exponential backoff until it
+// succeeds, the consumer is stopped or replaced, or the connection is lost again, in which case
+// the next reconnect re-subscribes it.
+func (m *ManagedConsumer) resubscribe(previous *amqp.Channel) {
+	wait := m.service.reconnectWait
+	for {
+		if m.service.isConnectionClosed() {
+			return
+		}
+
+		resubscribed, err := m.subscribe(previous)
+		if err == nil {
+			if resubscribed {
+				m.service.notifyResubscribe(m.config.QueueName, nil)
+			}
+			return
+		}
+		m.service.notifyResubscribe(m.config.QueueName, err)
+
+		log.Printf("Failed to re-subscribe consumer for queue %s: %v. Retrying in %s...", m.config.QueueName, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-m.done:
+			return
+		}
+		if wait *= 2; wait > maxResubscribeWait {
+			wait = maxResubscribeWait
+		}
+	}
+}
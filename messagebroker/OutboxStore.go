@@ -0,0 +1,116 @@
+package messagebroker
+
+import (
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// OutboxMessage is a message that has been accepted for publishing but not yet confirmed by RabbitMQ.
+type OutboxMessage struct {
+	ID         string    `gorm:"primaryKey;size:36" json:"id"`
+	Exchange   string    `gorm:"size:255" json:"exchange"`
+	RoutingKey string    `gorm:"size:255;not null" json:"routingKey"`
+	Body       []byte    `gorm:"not null" json:"body"`
+	Attempts   int       `gorm:"not null;default:0" json:"attempts"`
+	LastError  string    `gorm:"size:1024" json:"lastError,omitempty"`
+	CreatedAt  time.Time `gorm:"index" json:"createdAt"`
+}
+
+// TableName overrides the default GORM table name
+func (OutboxMessage) TableName() string {
+	return "outbox_messages"
+}
+
+// OutboxStore persists messages until the broker confirms them.
+// Implementations must be safe for concurrent use.
+type OutboxStore interface {
+	// Save stores a message before it is published
+	Save(msg OutboxMessage) error
+	// Pending returns up to limit unconfirmed messages, oldest first
+	Pending(limit int) ([]OutboxMessage, error)
+	// MarkFailed records a failed publish attempt
+	MarkFailed(id string, reason error) error
+	// Delete removes a message once the broker has confirmed it
+	Delete(id string) error
+}
+
+const maxOutboxErrorLength = 1024
+
+// truncateError shortens an error message so it fits the LastError column,
+// cutting at a character boundary so the result stays valid UTF-8.
+func truncateError(reason error) string {
+	if reason == nil {
+		return ""
+	}
+	msg := reason.Error()
+	if len(msg) > maxOutboxErrorLength {
+		cut := maxOutboxErrorLength
+		for cut > 0 && !utf8.RuneStart(msg[cut]) {
+			cut--
+		}
+		msg = msg[:cut]
+	}
+	return msg
+}
+
+// MemoryOutboxStore keeps unconfirmed messages in memory. Messages are lost when the process exits.
+type MemoryOutboxStore struct {
+	messages map[string]OutboxMessage
+	mutex    sync.Mutex
+}
+
+// NewMemoryOutboxStore creates an in-memory outbox store
+func NewMemoryOutboxStore() *MemoryOutboxStore {
+	return &MemoryOutboxStore{
+		messages: make(map[string]OutboxMessage),
+	}
+}
+
+// Save stores a message in memory
+func (s *MemoryOutboxStore) Save(msg OutboxMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.messages[msg.ID] = msg
+	return nil
+}
+
+// Pending returns the oldest unconfirmed messages
+func (s *MemoryOutboxStore) Pending(limit int) ([]OutboxMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	messages := make([]OutboxMessage, 0, len(s.messages))
+	for _, msg := range s.messages {
+		messages = append(messages, msg)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].CreatedAt.Before(messages[j].CreatedAt)
+	})
+	if limit > 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+// MarkFailed records a failed publish attempt
+func (s *MemoryOutboxStore) MarkFailed(id string, reason error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if msg, exists := s.messages[id]; exists {
+		msg.Attempts++
+		msg.LastError = truncateError(reason)
+		s.messages[id] = msg
+	}
+	return nil
+}
+
+// Delete removes a confirmed message
+func (s *MemoryOutboxStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.messages, id)
+	return nil
+}
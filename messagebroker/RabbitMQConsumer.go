@@ -1,14 +1,19 @@
 package messagebroker
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/streadway/amqp"
 )
 
 type RabbitMQConsumer struct {
-	service *RabbitMQService
+	service   *RabbitMQService
+	consumers []*ManagedConsumer
+	mutex     sync.Mutex
 }
 
 // NewRabbitMQConsumer creates a new consumer
@@ -16,29 +21,74 @@ func NewRabbitMQConsumer(service *RabbitMQService) *RabbitMQConsumer {
 	return &RabbitMQConsumer{service: service}
 }
 
-// Consume starts listening to messages and processes them with a handler
+// Consume starts listening to messages and processes them with a handler.
+// Messages are auto-acknowledged; use Start for manual acknowledgement.
+// The consumer is re-subscribed automatically after a RabbitMQ reconnect.
 func (c *RabbitMQConsumer) Consume(queueName string, handler func(msg amqp.Delivery) error) error {
-	msgs, err := c.service.Channel.Consume(
-		queueName,
-		"",    // Consumer tag
-		true,  // Auto-ack
-		false, // Exclusive
-		false, // No-local
-		false, // No-wait
-		nil,   // Arguments
-	)
+	consumer, err := c.service.RegisterConsumer(context.Background(), ConsumerConfig{
+		QueueName:   queueName,
+		Concurrency: 1,
+		AutoAck:     true,
+		Handler: func(_ *amqp.Channel, msg amqp.Delivery) {
+			if err := handler(msg); err != nil {
+				log.Printf("Error processing message: %v", err)
+			}
+		},
+	})
 	if err != nil {
 		return fmt.Errorf("failed to register consumer: %v", err)
 	}
+	c.track(consumer)
 
-	go func() {
-		for msg := range msgs {
+	log.Printf("Started consuming messages from queue: %s", queueName)
+	return nil
+}
+
+// Start consumes queueName with manual acknowledgement: a message is acked when the handler
+// returns nil and requeued when it returns an error. Cancelling ctx stops the consumer.
+// The consumer is re-subscribed automatically after a RabbitMQ reconnect.
+func (c *RabbitMQConsumer) Start(ctx context.Context, queueName string, concurrency int, handler func(msg amqp.Delivery) error) error {
+	consumer, err := c.service.RegisterConsumer(ctx, ConsumerConfig{
+		QueueName:   queueName,
+		Concurrency: concurrency,
+		Handler: func(_ *amqp.Channel, msg amqp.Delivery) {
 			if err := handler(msg); err != nil {
 				log.Printf("Error processing message: %v", err)
+				msg.Nack(false, true)
+				return
 			}
-		}
-	}()
+			msg.Ack(false)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	c.track(consumer)
 
 	log.Printf("Started consuming messages from queue: %s", queueName)
 	return nil
 }
+
+// Stop cancels every consumer started by this RabbitMQConsumer and waits for in-flight
+// handlers to finish until ctx expires.
+func (c *RabbitMQConsumer) Stop(ctx context.Context) error {
+	c.mutex.Lock()
+	consumers := c.consumers
+	c.consumers = nil
+	c.mutex.Unlock()
+
+	var errs []error
+	for _, consumer := range consumers {
+		if err := consumer.Stop(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// track remembers a consumer so Stop can cancel it
+func (c *RabbitMQConsumer) track(consumer *ManagedConsumer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.consumers = append(c.consumers, consumer)
+}
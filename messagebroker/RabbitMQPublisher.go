@@ -2,71 +2,111 @@ package messagebroker
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/streadway/amqp"
 )
 
+// ErrQueuedForRetry is returned by Publish when the message is stored in the outbox but not yet
+// confirmed by the broker. The message is retried in the background and is not lost; callers
+// must not publish it again.
+var ErrQueuedForRetry = errors.New("message queued in outbox for retry")
+
+// errDeliveryInProgress is returned by deliver when another goroutine is delivering the message
+var errDeliveryInProgress = errors.New("message is being delivered by another goroutine")
+
 type RabbitMQPublisher struct {
-	service       *RabbitMQService
-	retryInterval time.Duration
-	messageQueue  []queuedMessage
-	queueMutex    sync.Mutex
-	paused        bool
-}
+	service        *RabbitMQService
+	store          OutboxStore
+	retryInterval  time.Duration
+	confirmTimeout time.Duration
+	retryBatchSize int
+	retryNow       chan struct{}
+
+	channel      *amqp.Channel
+	confirms     chan amqp.Confirmation
+	publishMutex sync.Mutex // Serializes publishing and waiting for the broker confirmation
 
-type queuedMessage struct {
-	QueueName string
-	Message   []byte
+	inFlight   map[string]struct{}
+	queueMutex sync.Mutex
+	paused     bool
 }
 
-// NewRabbitMQPublisher creates a new publisher
+// NewRabbitMQPublisher creates a new publisher that keeps unconfirmed messages in memory
 func NewRabbitMQPublisher(service *RabbitMQService) *RabbitMQPublisher {
+	return NewRabbitMQPublisherWithOutbox(service, NewMemoryOutboxStore())
+}
+
+// NewRabbitMQPublisherWithOutbox creates a new publisher that persists every message in the
+// given outbox store until RabbitMQ confirms it, so messages survive process restarts.
+func NewRabbitMQPublisherWithOutbox(service *RabbitMQService, store OutboxStore) *RabbitMQPublisher {
 	publisher := &RabbitMQPublisher{
-		service:       service,
-		retryInterval: 5 * time.Second,
-		messageQueue:  make([]queuedMessage, 0),
-		paused:        false,
+		service:        service,
+		store:          store,
+		retryInterval:  5 * time.Second,
+		confirmTimeout: 10 * time.Second,
+		retryBatchSize: 100,
+		retryNow:       make(chan struct{}, 1),
+		inFlight:       make(map[string]struct{}),
+		paused:         false,
 	}
 
 	// Pause publishing during RabbitMQ reconnections
-	service.SetOnReconnect(func() {
+	service.AddOnReconnect(func() {
 		publisher.pausePublishing()
-		service.DeclareQueues()
+		publisher.resetChannel()
 		publisher.resumePublishing()
 	})
 
 	go publisher.retryMessages()
+	publisher.triggerRetry() // Deliver messages left in the outbox by a previous run
 	return publisher
 }
 
-// Publish sends a message to the specified queue
+// SetConfirmTimeout sets how long Publish waits for the broker to confirm a message
+func (p *RabbitMQPublisher) SetConfirmTimeout(timeout time.Duration) {
+	p.confirmTimeout = timeout
+}
+
+// Publish stores the message in the outbox and sends it to the specified queue.
+// The message is removed from the outbox only after RabbitMQ acknowledges it;
+// otherwise it is retried in the background and ErrQueuedForRetry is returned.
 func (p *RabbitMQPublisher) Publish(queueName string, message []byte) error {
-	if p.paused {
-		p.queueMessage(queueName, message)
-		return fmt.Errorf("publishing paused due to RabbitMQ reconnection")
-	}
+	return p.PublishToExchange("", queueName, message)
+}
 
-	err := p.service.Channel.Publish(
-		"",
-		queueName,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        message,
-		},
-	)
+// PublishToExchange stores the message in the outbox and sends it to an exchange with a routing key,
+// letting the exchange bindings fan it out to every interested queue.
+func (p *RabbitMQPublisher) PublishToExchange(exchange, routingKey string, message []byte) error {
+	return p.publish(exchange, routingKey, uuid.NewString(), message)
+}
 
-	if err != nil {
-		log.Printf("Failed to publish message: %v. Queuing for retry.", err)
-		p.queueMessage(queueName, message)
-		return fmt.Errorf("failed to publish message: %v", err)
+// publish stores the message in the outbox under the given ID and delivers it
+func (p *RabbitMQPublisher) publish(exchange, routingKey, messageID string, message []byte) error {
+	msg := OutboxMessage{
+		ID:         messageID,
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+		Body:       message,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := p.store.Save(msg); err != nil {
+		return fmt.Errorf("failed to store message in outbox: %w", err)
+	}
+
+	if p.isPaused() {
+		return fmt.Errorf("%w: publishing paused due to RabbitMQ reconnection", ErrQueuedForRetry)
 	}
 
+	if err := p.deliver(msg); err != nil {
+		log.Printf("Failed to publish message: %v. Kept in outbox for retry.", err)
+		return fmt.Errorf("%w: %v", ErrQueuedForRetry, err)
+	}
 	return nil
 }
 
@@ -80,34 +120,190 @@ func (p *RabbitMQPublisher) PublishEvent(queueName string, event interface{}) er
 	return p.Publish(queueName, message)
 }
 
-// retryMessages retries publishing queued messages
+// PublishEventToExchange marshals an event and publishes it to an exchange with a routing key
+func (p *RabbitMQPublisher) PublishEventToExchange(exchange, routingKey string, event interface{}) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	return p.PublishToExchange(exchange, routingKey, message)
+}
+
+// PublishEnvelope publishes an Event envelope to the specified queue.
+// The event ID is used as the AMQP message ID so consumers can deduplicate redeliveries.
+func (p *RabbitMQPublisher) PublishEnvelope(queueName string, event *Event) error {
+	return p.PublishEnvelopeToExchange("", queueName, event)
+}
+
+// PublishEnvelopeToExchange publishes an Event envelope to an exchange with a routing key
+func (p *RabbitMQPublisher) PublishEnvelopeToExchange(exchange, routingKey string, event *Event) error {
+	if event.ID == "" {
+		event.ID = uuid.NewString()
+	}
+	if event.SchemaVersion == 0 {
+		event.SchemaVersion = EventSchemaVersion
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now().UTC()
+	}
+
+	message, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	return p.publish(exchange, routingKey, event.ID, message)
+}
+
+// deliver publishes an outbox message and removes it from the outbox once confirmed
+func (p *RabbitMQPublisher) deliver(msg OutboxMessage) error {
+	if !p.claim(msg.ID) {
+		return errDeliveryInProgress
+	}
+	defer p.release(msg.ID)
+
+	if err := p.publishConfirmed(msg); err != nil {
+		if markErr := p.store.MarkFailed(msg.ID, err); markErr != nil {
+			log.Printf("Failed to record outbox failure for message %s: %v", msg.ID, markErr)
+		}
+		return err
+	}
+
+	if err := p.store.Delete(msg.ID); err != nil {
+		// The message was delivered; it may be sent again, which at-least-once consumers tolerate
+		log.Printf("Failed to remove confirmed message %s from outbox: %v", msg.ID, err)
+	}
+	return nil
+}
+
+// publishConfirmed publishes a message on the confirm channel and waits for the broker ack or nack
+func (p *RabbitMQPublisher) publishConfirmed(msg OutboxMessage) error {
+	p.publishMutex.Lock()
+	defer p.publishMutex.Unlock()
+
+	channel, confirms, err := p.confirmChannel()
+	if err != nil {
+		return err
+	}
+
+	err = channel.Publish(
+		msg.Exchange,
+		msg.RoutingKey,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    msg.ID,
+			Timestamp:    msg.CreatedAt,
+			Body:         msg.Body,
+		},
+	)
+	if err != nil {
+		p.closeChannel()
+		return err
+	}
+
+	select {
+	case confirm, ok := <-confirms:
+		if !ok {
+			p.closeChannel()
+			return fmt.Errorf("channel closed before broker confirmed message %s", msg.ID)
+		}
+		if !confirm.Ack {
+			return fmt.Errorf("broker rejected message %s", msg.ID)
+		}
+		return nil
+	case <-time.After(p.confirmTimeout):
+		// A late confirmation would be matched to the next message, so start over on a new channel
+		p.closeChannel()
+		return fmt.Errorf("timed out waiting for broker to confirm message %s", msg.ID)
+	}
+}
+
+// confirmChannel returns the publisher channel, opening it in confirm mode if needed.
+// Must be called with publishMutex held.
+func (p *RabbitMQPublisher) confirmChannel() (*amqp.Channel, chan amqp.Confirmation, error) {
+	if p.channel != nil {
+		return p.channel, p.confirms, nil
+	}
+
+	channel, err := p.service.NewChannel()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open publisher channel: %w", err)
+	}
+	if err := channel.Confirm(false); err != nil {
+		_ = channel.Close()
+		return nil, nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	p.channel = channel
+	p.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	return p.channel, p.confirms, nil
+}
+
+// closeChannel drops the publisher channel. Must be called with publishMutex held.
+func (p *RabbitMQPublisher) closeChannel() {
+	if p.channel != nil {
+		_ = p.channel.Close()
+	}
+	p.channel = nil
+	p.confirms = nil
+}
+
+// resetChannel drops the publisher channel so the next publish opens a fresh one
+func (p *RabbitMQPublisher) resetChannel() {
+	p.publishMutex.Lock()
+	defer p.publishMutex.Unlock()
+	p.closeChannel()
+}
+
+// retryMessages retries publishing messages left in the outbox
 func (p *RabbitMQPublisher) retryMessages() {
 	backoff := p.retryInterval
 	maxBackoff := 30 * time.Second
 
 	for {
-		time.Sleep(backoff)
-		if p.paused {
+		select {
+		case <-time.After(backoff):
+		case <-p.retryNow:
+		}
+		if p.isPaused() {
 			continue
 		}
 
-		p.queueMutex.Lock()
-		queue := p.messageQueue
-		p.messageQueue = nil // Clear the queue
-		p.queueMutex.Unlock()
+		pending, err := p.store.Pending(p.retryBatchSize)
+		if err != nil {
+			log.Printf("Failed to load outbox messages: %v", err)
+			continue
+		}
 
-		if len(queue) == 0 {
+		if len(pending) == 0 {
 			backoff = p.retryInterval // Reset backoff
 			continue
 		}
 
-		log.Printf("Retrying %d queued messages...", len(queue))
-		for _, msg := range queue {
-			if err := p.Publish(msg.QueueName, msg.Message); err != nil {
-				p.queueMessage(msg.QueueName, msg.Message)
+		log.Printf("Retrying %d outbox messages...", len(pending))
+		failed := false
+		for _, msg := range pending {
+			if err := p.deliver(msg); errors.Is(err, errDeliveryInProgress) {
+				continue // Publish is delivering it
+			} else if err != nil {
+				log.Printf("Retry of message %s failed: %v", msg.ID, err)
+				failed = true
+				break // Keep the outbox order; try again after the backoff
 			}
 		}
 
+		if !failed {
+			backoff = p.retryInterval
+			if len(pending) == p.retryBatchSize {
+				p.triggerRetry() // More messages are waiting
+			}
+			continue
+		}
+
 		// Increase backoff for subsequent retries, up to maxBackoff
 		if backoff < maxBackoff {
 			backoff *= 2
@@ -118,22 +314,44 @@ func (p *RabbitMQPublisher) retryMessages() {
 	}
 }
 
-// queueMessage adds a message to the retry queue
-func (p *RabbitMQPublisher) queueMessage(queueName string, message []byte) {
+// TriggerDelivery publishes the messages pending in the outbox without waiting for the next poll,
+// e.g. after committing a transaction that enqueued events
+func (p *RabbitMQPublisher) TriggerDelivery() {
+	p.triggerRetry()
+}
+
+// triggerRetry wakes up the retry loop without waiting for the backoff
+func (p *RabbitMQPublisher) triggerRetry() {
+	select {
+	case p.retryNow <- struct{}{}:
+	default:
+	}
+}
+
+// claim marks a message as being delivered; it returns false if it already is
+func (p *RabbitMQPublisher) claim(id string) bool {
 	p.queueMutex.Lock()
 	defer p.queueMutex.Unlock()
 
-	for _, msg := range p.messageQueue {
-		if string(msg.Message) == string(message) && msg.QueueName == queueName {
-			log.Printf("Message already queued, skipping duplicate for queue: %s", queueName)
-			return
-		}
+	if _, exists := p.inFlight[id]; exists {
+		return false
 	}
+	p.inFlight[id] = struct{}{}
+	return true
+}
 
-	p.messageQueue = append(p.messageQueue, queuedMessage{
-		QueueName: queueName,
-		Message:   message,
-	})
+// release clears the in-flight mark of a message
+func (p *RabbitMQPublisher) release(id string) {
+	p.queueMutex.Lock()
+	defer p.queueMutex.Unlock()
+	delete(p.inFlight, id)
+}
+
+// isPaused reports whether publishing is paused
+func (p *RabbitMQPublisher) isPaused() bool {
+	p.queueMutex.Lock()
+	defer p.queueMutex.Unlock()
+	return p.paused
 }
 
 // pausePublishing pauses message publishing
@@ -149,5 +367,5 @@ func (p *RabbitMQPublisher) resumePublishing() {
 	defer p.queueMutex.Unlock()
 	p.paused = false
 	log.Println("Publishing resumed after RabbitMQ reconnection. Processing queued messages immediately.")
-	go p.retryMessages() // Trigger immediate retry for queued messages
+	p.triggerRetry() // Trigger immediate retry for queued messages
 }
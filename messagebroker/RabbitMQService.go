@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/streadway/amqp"
@@ -16,8 +17,17 @@ type RabbitMQService struct {
 	notifyClose   chan *amqp.Error
 	reconnectWait time.Duration
 	queueNames    []string
+	topologies    []Topology
+	topologyMutex sync.Mutex // Protects the registered topologies
 	onReconnect   func()
+	hooks         []func()   // Reconnect hooks added with AddOnReconnect
+	hooksMutex    sync.Mutex // Protects the reconnect hooks
 	mutex         sync.Mutex // Protects reconnection and channel reinitialization
+
+	consumers       []*ManagedConsumer
+	consumersMutex  sync.Mutex // Protects the registered consumers and onResubscribe
+	onResubscribe   func(queueName string, err error)
+	resubscriptions atomic.Int64
 }
 
 // NewRabbitMQService initializes RabbitMQ with auto-reconnection and queue declaration.
@@ -59,6 +69,11 @@ func (s *RabbitMQService) connect() error {
 	if err := s.DeclareQueues(); err != nil {
 		return fmt.Errorf("failed to declare queues: %v", err)
 	}
+
+	// Declare exchanges and bindings registered through DeclareTopology
+	if err := s.redeclareTopologies(); err != nil {
+		return fmt.Errorf("failed to declare topology: %v", err)
+	}
 	return nil
 }
 
@@ -100,6 +115,13 @@ func (s *RabbitMQService) NewChannel() (*amqp.Channel, error) {
 	return s.Conn.Channel()
 }
 
+// isConnectionClosed reports whether the current connection is down
+func (s *RabbitMQService) isConnectionClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Conn == nil || s.Conn.IsClosed()
+}
+
 // Close cleans up the RabbitMQ connection and channel.
 func (s *RabbitMQService) Close() {
 	s.mutex.Lock()
@@ -132,6 +154,8 @@ func (s *RabbitMQService) handleReconnect() {
 				if s.onReconnect != nil {
 					s.onReconnect()
 				}
+				s.runReconnectHooks()
+				s.resubscribeConsumers()
 				break
 			}
 		}
@@ -150,3 +174,21 @@ func (s *RabbitMQService) SetOnReconnect(callback func()) {
 		}
 	}
 }
+
+// AddOnReconnect adds a callback that runs after every reconnect, alongside the one set by SetOnReconnect
+func (s *RabbitMQService) AddOnReconnect(callback func()) {
+	s.hooksMutex.Lock()
+	defer s.hooksMutex.Unlock()
+	s.hooks = append(s.hooks, callback)
+}
+
+// runReconnectHooks runs the callbacks added with AddOnReconnect
+func (s *RabbitMQService) runReconnectHooks() {
+	s.hooksMutex.Lock()
+	hooks := append([]func(){}, s.hooks...)
+	s.hooksMutex.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+}
@@ -0,0 +1,179 @@
+package messagebroker
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers used to track retries and dead-lettering
+const (
+	RetryCountHeader    = "x-retry-count"
+	FailureReasonHeader = "x-failure-reason"
+	FailedAtHeader      = "x-failed-at"
+	OriginalQueueHeader = "x-original-queue"
+)
+
+// RetryPolicy controls how failed messages are retried before they are dead-lettered.
+// Each delay has its own retry queue ("<queue>.retry.<delay in ms>") whose TTL expires the message
+// back into the main queue, so delays grow exponentially without blocking other messages.
+// After MaxAttempts failures the message is moved to "<queue>.dlq" with the failure reason attached.
+//
+// The TTL is part of the queue name, so a changed backoff declares new retry queues instead of
+// redeclaring existing ones with different arguments, which the broker rejects. Retry queues of
+// the previous backoff, including the "<queue>.retry.<n>" queues of earlier versions, still expire
+// their messages into the main queue; delete them once they are empty.
+type RetryPolicy struct {
+	MaxAttempts    int           // Total processing attempts; 0 disables retries and requeues immediately
+	InitialBackoff time.Duration // Delay before the first retry
+	MaxBackoff     time.Duration // Upper bound for the delay
+	Multiplier     float64       // Growth factor between retries
+}
+
+// DefaultRetryPolicy returns a policy with 5 attempts and exponential backoff starting at 1 second
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Minute,
+		Multiplier:     2,
+	}
+}
+
+// Enabled reports whether failed messages are retried through retry queues
+func (p RetryPolicy) Enabled() bool {
+	return p.MaxAttempts > 0
+}
+
+// Backoff returns the delay before the given retry (1-based)
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := time.Duration(float64(p.InitialBackoff) * math.Pow(multiplier, float64(retry-1)))
+	if p.MaxBackoff > 0 && (delay > p.MaxBackoff || delay <= 0) {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// RetryQueueName returns the name of the retry queue holding messages for the given delay
+func RetryQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", queueName, delay.Milliseconds())
+}
+
+// DeadLetterQueueName returns the name of the dead-letter queue of a queue
+func DeadLetterQueueName(queueName string) string {
+	return queueName + ".dlq"
+}
+
+// Topology returns the retry queues and dead-letter queue needed for the given queue
+func (p RetryPolicy) Topology(queueName string) Topology {
+	var topology Topology
+	declared := make(map[int64]bool)
+	for retry := 1; retry < p.MaxAttempts; retry++ {
+		delay := p.Backoff(retry)
+		if declared[delay.Milliseconds()] {
+			continue // Retries capped at MaxBackoff share a queue
+		}
+		declared[delay.Milliseconds()] = true
+
+		topology.Queues = append(topology.Queues, QueueConfig{
+			Name:    RetryQueueName(queueName, delay),
+			Durable: true,
+			Args: amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queueName,
+			},
+		})
+	}
+	topology.Queues = append(topology.Queues, QueueConfig{
+		Name:    DeadLetterQueueName(queueName),
+		Durable: true,
+	})
+	return topology
+}
+
+// Declare declares the retry and dead-letter queues of a queue on the given channel
+func (p RetryPolicy) Declare(channel *amqp.Channel, queueName string) error {
+	if !p.Enabled() {
+		return nil
+	}
+	return declareTopology(channel, p.Topology(queueName))
+}
+
+// RetryAttempts returns how many times a delivery has already failed
+func RetryAttempts(msg amqp.Delivery) int {
+	switch v := msg.Headers[RetryCountHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
+	}
+}
+
+// RetryOrDeadLetter republishes a failed delivery to its next retry queue, or to the dead-letter
+// queue once the policy is exhausted. It returns nil only after the broker confirmed the copy;
+// the caller then acks the original delivery, and nacks it with requeue otherwise.
+func RetryOrDeadLetter(publisher *ConfirmPublisher, msg amqp.Delivery, queueName string, policy RetryPolicy, reason error) error {
+	attempts := RetryAttempts(msg) + 1
+
+	headers := amqp.Table{}
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[RetryCountHeader] = int32(attempts)
+	headers[OriginalQueueHeader] = queueName
+	if reason != nil {
+		headers[FailureReasonHeader] = reason.Error()
+	}
+
+	target := RetryQueueName(queueName, policy.Backoff(attempts))
+	if attempts >= policy.MaxAttempts {
+		target = DeadLetterQueueName(queueName)
+		headers[FailedAtHeader] = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	return republish(publisher, msg, target, headers)
+}
+
+// Defer republishes a delivery to the retry queue of the first retry without counting an attempt,
+// e.g. while the same event is still being processed by another delivery. The retry queue exists
+// only when the policy allows more than one attempt. It returns nil only after the broker
+// confirmed the copy; the caller then acks the original delivery.
+func Defer(publisher *ConfirmPublisher, msg amqp.Delivery, queueName string, policy RetryPolicy) error {
+	if policy.MaxAttempts < 2 {
+		return fmt.Errorf("retry policy of queue %s has no retry queue", queueName)
+	}
+	return republish(publisher, msg, RetryQueueName(queueName, policy.Backoff(1)), msg.Headers)
+}
+
+// republish publishes a copy of a delivery with the given headers and waits for its confirmation
+func republish(publisher *ConfirmPublisher, msg amqp.Delivery, target string, headers amqp.Table) error {
+	err := publisher.Publish(
+		"",
+		target,
+		amqp.Publishing{
+			Headers:       headers,
+			ContentType:   msg.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: msg.CorrelationId,
+			MessageId:     msg.MessageId,
+			Timestamp:     msg.Timestamp,
+			Type:          msg.Type,
+			Body:          msg.Body,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to publish message to %s: %w", target, err)
+	}
+	return nil
+}
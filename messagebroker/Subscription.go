@@ -0,0 +1,235 @@
+package messagebroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+// ErrSubscriptionClosed is returned when the delivery channel closes without Stop being called,
+// e.g. because the RabbitMQ channel or connection was closed.
+var ErrSubscriptionClosed = errors.New("delivery channel closed")
+
+// Subscription is a running consumer on a queue. Deliveries are handled by up to concurrency
+// goroutines; Stop cancels the consumer tag and waits for in-flight handlers to finish.
+type Subscription struct {
+	channel     *amqp.Channel
+	queueName   string
+	tag         string
+	autoAck     bool
+	concurrency int
+	handler     func(msg amqp.Delivery)
+	keyFunc     func(msg amqp.Delivery) string
+
+	inFlight  sync.WaitGroup
+	done      chan struct{}
+	stopping  chan struct{}
+	stopOnce  sync.Once
+	cancelErr error
+	err       error
+}
+
+// Subscribe starts consuming queueName on the given channel. With autoAck false the handler is
+// responsible for acking or nacking each delivery. Cancelling ctx stops the subscription the same
+// way Stop does; use Done or Wait to know when in-flight handlers have finished.
+func Subscribe(ctx context.Context, channel *amqp.Channel, queueName string, concurrency int, autoAck bool, handler func(msg amqp.Delivery)) (*Subscription, error) {
+	return SubscribeOrdered(ctx, channel, queueName, concurrency, autoAck, nil, handler)
+}
+
+// SubscribeOrdered works like Subscribe, but deliveries with the same key are always handled
+// by the same worker, so they are processed one at a time in arrival order.
+// A nil keyFunc handles deliveries in any order.
+func SubscribeOrdered(ctx context.Context, channel *amqp.Channel, queueName string, concurrency int, autoAck bool, keyFunc func(msg amqp.Delivery) string, handler func(msg amqp.Delivery)) (*Subscription, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	s := &Subscription{
+		channel:     channel,
+		queueName:   queueName,
+		tag:         fmt.Sprintf("%s-%s", queueName, uuid.NewString()),
+		autoAck:     autoAck,
+		concurrency: concurrency,
+		handler:     handler,
+		keyFunc:     keyFunc,
+		done:        make(chan struct{}),
+		stopping:    make(chan struct{}),
+	}
+
+	msgs, err := channel.Consume(
+		queueName,
+		s.tag,   // Consumer tag
+		autoAck, // Auto-ack
+		false,   // Exclusive
+		false,   // No-local
+		false,   // No-wait
+		nil,     // Arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register consumer: %w", err)
+	}
+
+	go s.dispatch(msgs)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.cancel()
+		case <-s.done:
+		}
+	}()
+
+	return s, nil
+}
+
+// QueueName returns the consumed queue
+func (s *Subscription) QueueName() string {
+	return s.queueName
+}
+
+// Tag returns the consumer tag
+func (s *Subscription) Tag() string {
+	return s.tag
+}
+
+// Done is closed once the subscription has stopped and all in-flight handlers have returned
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the subscription stopped; nil after a clean Stop
+func (s *Subscription) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Stop cancels the consumer and waits for in-flight handlers until ctx expires.
+// Deliveries received after Stop are requeued instead of being handled.
+func (s *Subscription) Stop(ctx context.Context) error {
+	s.cancel()
+	if err := s.Wait(ctx); err != nil {
+		return err
+	}
+	return s.cancelErr
+}
+
+// Wait blocks until the subscription has stopped or ctx expires
+func (s *Subscription) Wait(ctx context.Context) error {
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for in-flight messages on queue %s: %w", s.queueName, ctx.Err())
+	}
+}
+
+// cancel stops delivery from the broker; the delivery channel closes once the broker confirms
+func (s *Subscription) cancel() {
+	s.stopOnce.Do(func() {
+		close(s.stopping)
+		if err := s.channel.Cancel(s.tag, false); err != nil && err != amqp.ErrClosed {
+			s.cancelErr = fmt.Errorf("failed to cancel consumer %s: %w", s.tag, err)
+		}
+	})
+}
+
+// isStopping reports whether Stop has been requested
+func (s *Subscription) isStopping() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// dispatch hands deliveries to the worker pool until the delivery channel closes
+func (s *Subscription) dispatch(msgs <-chan amqp.Delivery) {
+	defer close(s.done)
+
+	if s.keyFunc != nil {
+		s.dispatchOrdered(msgs)
+	} else {
+		s.dispatchUnordered(msgs)
+	}
+
+	if !s.isStopping() {
+		s.err = ErrSubscriptionClosed
+		log.Printf("Consumer %s on queue %s stopped: %v", s.tag, s.queueName, s.err)
+		return
+	}
+	log.Printf("Consumer %s on queue %s stopped", s.tag, s.queueName)
+}
+
+// dispatchUnordered runs each delivery in its own goroutine, bounded by concurrency
+func (s *Subscription) dispatchUnordered(msgs <-chan amqp.Delivery) {
+	workers := make(chan struct{}, s.concurrency)
+	for msg := range msgs {
+		if s.requeueIfStopping(msg) {
+			continue
+		}
+
+		workers <- struct{}{}
+		s.inFlight.Add(1)
+		go func(m amqp.Delivery) {
+			defer func() {
+				<-workers
+				s.inFlight.Done()
+			}()
+			s.handler(m)
+		}(msg)
+	}
+
+	s.inFlight.Wait()
+}
+
+// dispatchOrdered hashes each delivery key onto a fixed worker
+func (s *Subscription) dispatchOrdered(msgs <-chan amqp.Delivery) {
+	queues := make([]chan amqp.Delivery, s.concurrency)
+	for i := range queues {
+		queues[i] = make(chan amqp.Delivery)
+		s.inFlight.Add(1)
+		go func(queue <-chan amqp.Delivery) {
+			defer s.inFlight.Done()
+			for m := range queue {
+				s.handler(m)
+			}
+		}(queues[i])
+	}
+
+	for msg := range msgs {
+		if s.requeueIfStopping(msg) {
+			continue
+		}
+
+		hash := fnv.New32a()
+		hash.Write([]byte(s.keyFunc(msg)))
+		queues[hash.Sum32()%uint32(len(queues))] <- msg
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	s.inFlight.Wait()
+}
+
+// requeueIfStopping gives a delivery back to the broker when Stop has been requested.
+// It was already buffered by the client and can go to another consumer.
+func (s *Subscription) requeueIfStopping(msg amqp.Delivery) bool {
+	if !s.isStopping() {
+		return false
+	}
+	if !s.autoAck {
+		msg.Nack(false, true)
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+package messagebroker
+
+import (
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// ExchangeConfig describes an exchange to declare.
+// Kind is one of amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic or amqp.ExchangeHeaders.
+type ExchangeConfig struct {
+	Name       string
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	Args       amqp.Table
+}
+
+// QueueConfig describes a queue to declare, including optional arguments
+// such as x-message-ttl, x-dead-letter-exchange or x-max-length.
+type QueueConfig struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       amqp.Table
+}
+
+// BindingConfig binds a queue to an exchange with a routing key (or header arguments for headers exchanges).
+type BindingConfig struct {
+	Queue      string
+	Exchange   string
+	RoutingKey string
+	Args       amqp.Table
+}
+
+// Topology groups exchanges, queues and bindings that are declared together.
+//
+// Example: fan out one event to several services
+//
+//	topology := messagebroker.Topology{
+//		Exchanges: []messagebroker.ExchangeConfig{{Name: "sph.events", Kind: amqp.ExchangeTopic, Durable: true}},
+//		Queues: []messagebroker.QueueConfig{
+//			{Name: "sph.search-indexer", Durable: true},
+//			{Name: "sph.audit", Durable: true},
+//		},
+//		Bindings: []messagebroker.BindingConfig{
+//			{Queue: "sph.search-indexer", Exchange: "sph.events", RoutingKey: "sph.#"},
+//			{Queue: "sph.audit", Exchange: "sph.events", RoutingKey: "sph.#"},
+//		},
+//	}
+type Topology struct {
+	Exchanges []ExchangeConfig
+	Queues    []QueueConfig
+	Bindings  []BindingConfig
+}
+
+// DeclareTopology declares the given topology and, once it is declared successfully, remembers it
+// so it is declared again after every reconnect. A topology that fails is not remembered, so an
+// invalid one cannot break every later reconnect. It declares on a channel of its own, so a
+// declaration the broker rejects does not close the shared channel.
+func (s *RabbitMQService) DeclareTopology(topology Topology) error {
+	channel, err := s.NewChannel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel to declare topology: %w", err)
+	}
+	defer channel.Close()
+
+	if err := declareTopology(channel, topology); err != nil {
+		return err
+	}
+
+	s.topologyMutex.Lock()
+	s.topologies = append(s.topologies, topology)
+	s.topologyMutex.Unlock()
+	return nil
+}
+
+// DeclareExchange declares a durable exchange of the given kind and remembers it for reconnects.
+func (s *RabbitMQService) DeclareExchange(name, kind string) error {
+	return s.DeclareTopology(Topology{
+		Exchanges: []ExchangeConfig{{Name: name, Kind: kind, Durable: true}},
+	})
+}
+
+// BindQueue binds a queue to an exchange with a routing key and remembers the binding for reconnects.
+func (s *RabbitMQService) BindQueue(queueName, exchange, routingKey string) error {
+	return s.DeclareTopology(Topology{
+		Bindings: []BindingConfig{{Queue: queueName, Exchange: exchange, RoutingKey: routingKey}},
+	})
+}
+
+// redeclareTopologies declares every topology registered with DeclareTopology on a channel of its own.
+// It is called by connect with the service mutex held.
+func (s *RabbitMQService) redeclareTopologies() error {
+	s.topologyMutex.Lock()
+	topologies := append([]Topology(nil), s.topologies...)
+	s.topologyMutex.Unlock()
+	if len(topologies) == 0 {
+		return nil
+	}
+
+	channel, err := s.Conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel to declare topology: %w", err)
+	}
+	defer channel.Close()
+
+	for _, topology := range topologies {
+		if err := declareTopology(channel, topology); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// declareTopology declares exchanges first, then queues, then bindings.
+func declareTopology(channel *amqp.Channel, topology Topology) error {
+	for _, exchange := range topology.Exchanges {
+		err := channel.ExchangeDeclare(
+			exchange.Name,
+			exchange.Kind,
+			exchange.Durable,
+			exchange.AutoDelete,
+			exchange.Internal,
+			false, // No-wait
+			exchange.Args,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare exchange '%s': %w", exchange.Name, err)
+		}
+	}
+
+	for _, queue := range topology.Queues {
+		_, err := channel.QueueDeclare(
+			queue.Name,
+			queue.Durable,
+			queue.AutoDelete,
+			queue.Exclusive,
+			false, // No-wait
+			queue.Args,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare queue '%s': %w", queue.Name, err)
+		}
+	}
+
+	for _, binding := range topology.Bindings {
+		err := channel.QueueBind(
+			binding.Queue,
+			binding.RoutingKey,
+			binding.Exchange,
+			false, // No-wait
+			binding.Args,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to bind queue '%s' to exchange '%s': %w", binding.Queue, binding.Exchange, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package messagebroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Transactional outbox
+//
+// Services enqueue events with the same *gorm.DB transaction as the business write, so the event
+// is committed or rolled back together with the data. The rows go to the outbox_messages table of
+// GormOutboxStore, and the publisher created with NewRabbitMQPublisherWithOutbox on that store
+// relays them: it publishes pending messages oldest first and deletes each one once the broker
+// confirms it. Run a single publisher per database to keep that order.
+//
+// Example:
+//
+//	store, _ := messagebroker.NewGormOutboxStore(db)
+//	publisher := messagebroker.NewRabbitMQPublisherWithOutbox(rabbitService, store)
+//
+//	err := db.Transaction(func(tx *gorm.DB) error {
+//		if err := tx.Create(&sph).Error; err != nil {
+//			return err
+//		}
+//		return store.EnqueueEvent(tx, "sph.events", sphCreated)
+//	})
+//	if err == nil {
+//		publisher.TriggerDelivery() // Publish now instead of on the next poll
+//	}
+
+// EnqueueEvent marshals an event and stores it in the outbox using the given transaction,
+// to be published to the given queue.
+func (s *GormOutboxStore) EnqueueEvent(tx *gorm.DB, queueName string, event interface{}) error {
+	return s.EnqueueEventToExchange(tx, "", queueName, event)
+}
+
+// EnqueueEventToExchange stores an event in the outbox using the given transaction,
+// to be published to an exchange with a routing key.
+func (s *GormOutboxStore) EnqueueEventToExchange(tx *gorm.DB, exchange, routingKey string, event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	return s.SaveTx(tx, OutboxMessage{
+		ID:         uuid.NewString(),
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+		Body:       body,
+		CreatedAt:  time.Now().UTC(),
+	})
+}
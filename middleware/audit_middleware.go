@@ -0,0 +1,308 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/NHadi/AmanahPro-common/models"
+	"github.com/NHadi/AmanahPro-common/services"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	auditStateKey      = "audit.state"
+	auditResourceIDKey = "audit.resourceId"
+	auditSkipKey       = "audit.skip"
+)
+
+// redactedValue replaces the values of redacted fields
+const redactedValue = "[REDACTED]"
+
+// auditRecordTimeout bounds how long a request waits for its audit record to be stored
+const auditRecordTimeout = 5 * time.Second
+
+// AuditRoute selects a route to audit
+type AuditRoute struct {
+	Method   string // e.g. "PUT"; empty for every audited method
+	Path     string // Route pattern as registered, e.g. "/api/projects/:id"
+	Resource string // Defaults to Path
+	Action   string // Defaults to CREATE, UPDATE or DELETE by method
+	IDParam  string // Route parameter holding the resource ID, default "id"
+}
+
+// AuditConfig configures AuditMiddleware
+type AuditConfig struct {
+	Routes       []AuditRoute
+	Methods      []string // Default POST, PUT, PATCH and DELETE
+	RedactFields []string // Body fields and route parameters to redact, case-insensitive; defaults to common credentials
+	MaxBodySize  int      // Bodies larger than this are not stored, default 64 KB
+}
+
+// auditState is the old and new state a handler attached with SetAuditState
+type auditState struct {
+	oldData interface{}
+	newData interface{}
+}
+
+// SetAuditState attaches the old and new state of the resource to the audit record of the request
+func SetAuditState(c *gin.Context, oldData, newData interface{}) {
+	c.Set(auditStateKey, auditState{oldData: oldData, newData: newData})
+}
+
+// SetAuditResourceID sets the resource ID of the audit record, e.g. the ID of a created resource
+func SetAuditResourceID(c *gin.Context, resourceID interface{}) {
+	c.Set(auditResourceIDKey, resourceID)
+}
+
+// SkipAudit prevents the request from being audited
+func SkipAudit(c *gin.Context) {
+	c.Set(auditSkipKey, true)
+}
+
+// readCloser combines a reader with the closer of the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// auditResponseWriter captures the response body up to a limit
+type auditResponseWriter struct {
+	gin.ResponseWriter
+	body      *bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// Write captures the response body while writing it to the client
+func (w *auditResponseWriter) Write(data []byte) (int, error) {
+	if !w.truncated {
+		if w.body.Len()+len(data) > w.limit {
+			w.truncated = true
+			w.body.Reset()
+		} else {
+			w.body.Write(data)
+		}
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// AuditMiddleware records an audit record for each successful request matching the configured
+// routes, with the authenticated user, trace ID, route parameters and redacted JSON bodies.
+// Handlers attach the resource state with SetAuditState. Register it after JWTAuthMiddleware.
+func AuditMiddleware(auditService *services.AuditTrailService, config AuditConfig) gin.HandlerFunc {
+	methods := config.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	}
+	auditedMethods := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		auditedMethods[strings.ToUpper(method)] = true
+	}
+
+	redactFields := config.RedactFields
+	if len(redactFields) == 0 {
+		redactFields = []string{"password", "newPassword", "oldPassword", "token", "accessToken", "refreshToken", "secret", "apiKey", "authorization"}
+	}
+	redact := make(map[string]bool, len(redactFields))
+	for _, field := range redactFields {
+		redact[strings.ToLower(field)] = true
+	}
+
+	maxBodySize := config.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = 64 * 1024
+	}
+
+	return func(c *gin.Context) {
+		if !auditedMethods[c.Request.Method] {
+			c.Next()
+			return
+		}
+		route, ok := matchAuditRoute(config.Routes, c.Request.Method, c.FullPath())
+		if !ok {
+			c.Next()
+			return
+		}
+
+		var requestBody []byte
+		if c.Request.Body != nil {
+			// Read only what can be stored, so large uploads are not buffered
+			prefix, err := io.ReadAll(io.LimitReader(c.Request.Body, int64(maxBodySize)+1))
+			if err != nil {
+				log.Printf("Audit: failed to read request body: %v", err)
+			}
+			c.Request.Body = readCloser{ // Restore the body for the handler
+				Reader: io.MultiReader(bytes.NewReader(prefix), c.Request.Body),
+				Closer: c.Request.Body,
+			}
+			if len(prefix) <= maxBodySize {
+				requestBody = prefix
+			}
+		}
+
+		responseWriter := &auditResponseWriter{
+			ResponseWriter: c.Writer,
+			body:           &bytes.Buffer{},
+			limit:          maxBodySize,
+		}
+		c.Writer = responseWriter
+
+		c.Next()
+
+		status := responseWriter.Status()
+		if status >= http.StatusBadRequest || c.GetBool(auditSkipKey) {
+			return
+		}
+
+		params := make(map[string]string, len(c.Params))
+		for _, param := range c.Params {
+			params[param.Key] = param.Value
+		}
+		path := c.Request.URL.Path
+		for key := range params {
+			if redact[strings.ToLower(key)] {
+				params[key] = redactedValue
+				path = "" // The path contains the value
+			}
+		}
+		resourceID := params[route.IDParam]
+		if path == "" {
+			path = expandRoute(c.FullPath(), params)
+		}
+
+		entry := services.AuditEntry{
+			TraceID:    auditTraceID(c),
+			Action:     route.Action,
+			Resource:   route.Resource,
+			ResourceID: resourceID,
+			IPAddress:  c.ClientIP(),
+			UserAgent:  c.Request.UserAgent(),
+			Request: &services.AuditRequest{
+				Method:       c.Request.Method,
+				Route:        c.FullPath(),
+				Path:         path,
+				Params:       params,
+				Status:       status,
+				Body:         redactBody(requestBody, redact),
+				ResponseBody: redactBody(responseWriter.body.Bytes(), redact),
+			},
+		}
+		if claims, ok := c.Get("user"); ok {
+			entry.Claims, _ = claims.(*models.JWTClaims)
+		}
+		if resourceID, ok := c.Get(auditResourceIDKey); ok {
+			entry.ResourceID = resourceID
+		}
+		if value, ok := c.Get(auditStateKey); ok {
+			state := value.(auditState)
+			entry.OldData = state.oldData
+			entry.NewData = state.newData
+		}
+
+		// Store the record even when the client has already disconnected
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), auditRecordTimeout)
+		defer cancel()
+		if _, err := auditService.Record(ctx, entry); err != nil {
+			log.Printf("Audit: failed to record %s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+		}
+	}
+}
+
+// matchAuditRoute returns the configured route for a request with its defaults applied
+func matchAuditRoute(routes []AuditRoute, method, fullPath string) (AuditRoute, bool) {
+	if fullPath == "" {
+		return AuditRoute{}, false // No route matched
+	}
+
+	for _, route := range routes {
+		if route.Path != fullPath || (route.Method != "" && !strings.EqualFold(route.Method, method)) {
+			continue
+		}
+		if route.Resource == "" {
+			route.Resource = route.Path
+		}
+		if route.Action == "" {
+			route.Action = auditAction(method)
+		}
+		if route.IDParam == "" {
+			route.IDParam = "id"
+		}
+		return route, true
+	}
+	return AuditRoute{}, false
+}
+
+// expandRoute fills the parameters of a route pattern, e.g. "/reset/:token", with their values
+func expandRoute(route string, params map[string]string) string {
+	segments := strings.Split(route, "/")
+	for i, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, ":"):
+			segments[i] = params[segment[1:]]
+		case strings.HasPrefix(segment, "*"):
+			segments[i] = strings.TrimPrefix(params[segment[1:]], "/")
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// auditAction returns the default action of a method
+func auditAction(method string) string {
+	switch method {
+	case http.MethodPost:
+		return "CREATE"
+	case http.MethodDelete:
+		return "DELETE"
+	default:
+		return "UPDATE"
+	}
+}
+
+// auditTraceID returns the trace ID set by TraceIDMiddleware, or the request header
+func auditTraceID(c *gin.Context) string {
+	if traceID := c.GetString(TraceIDHeader); traceID != "" {
+		return traceID
+	}
+	return c.GetHeader(TraceIDHeader)
+}
+
+// redactBody parses a JSON body and redacts the configured fields at any depth.
+// Bodies that are empty or not JSON are not stored.
+func redactBody(body []byte, redact map[string]bool) interface{} {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil
+	}
+	return redactValue(value, redact)
+}
+
+// redactValue replaces the values of redacted fields in a decoded JSON value
+func redactValue(value interface{}, redact map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if redact[strings.ToLower(key)] {
+				v[key] = redactedValue
+			} else {
+				v[key] = redactValue(field, redact)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item, redact)
+		}
+	}
+	return value
+}
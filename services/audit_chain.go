@@ -0,0 +1,452 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/NHadi/AmanahPro-common/helpers"
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// Fields added to chained audit documents
+const (
+	chainIDField   = "chainId"
+	sequenceField  = "sequence"
+	prevHashField  = "prevHash"
+	hashField      = "hash"
+	hmacField      = "hmac"
+	maxChainAppend = 100 // Attempts to claim the next sequence before giving up
+)
+
+// Chain issue kinds reported by Verify
+const (
+	ChainIssueGap         = "gap"          // Sequences are missing, i.e. records were deleted
+	ChainIssueDuplicate   = "duplicate"    // A sequence appears more than once
+	ChainIssueBrokenLink  = "broken_link"  // prevHash does not match the previous record
+	ChainIssueModified    = "modified"     // The record no longer matches its hash
+	ChainIssueInvalidHMAC = "invalid_hmac" // The hash was recomputed without the key
+	ChainIssueTruncated   = "truncated"    // Records written by this process are missing from the end
+)
+
+// ChainLink is the position of a record in its hash chain
+type ChainLink struct {
+	ChainID  string `json:"chainId"`
+	Sequence int64  `json:"sequence"`
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+	HMAC     string `json:"hmac,omitempty"`
+}
+
+// ChainIssue is a problem found while verifying a chain
+type ChainIssue struct {
+	Kind       string
+	Sequence   int64
+	DocumentID string
+	Detail     string
+}
+
+// ChainVerification is the outcome of verifying a chain
+type ChainVerification struct {
+	ChainID      string
+	Records      int64
+	LastSequence int64
+	Issues       []ChainIssue
+}
+
+// Valid reports whether no issues were found
+func (v *ChainVerification) Valid() bool {
+	return len(v.Issues) == 0
+}
+
+type chainState struct {
+	mutex sync.Mutex
+	head  *ChainLink // Last link appended or seen by this process
+}
+
+// AuditChain appends documents to tamper-evident hash chains, one chain per organization and
+// resource. Each document carries the hash of the previous one, its own hash, and an HMAC of
+// its hash, so editing, deleting or inserting records breaks the chain and recomputing the
+// hashes requires the key. Documents get the ID "<chainId>:<sequence>" and are created with
+// op_type=create, so concurrent writers in other processes cannot claim the same sequence.
+// The index needs the mappings of AuditChainProperties; see EnsureMappings.
+type AuditChain struct {
+	esClient *elasticsearch.Client
+	index    string
+	key      []byte
+	chains   map[string]*chainState
+	mutex    sync.Mutex
+}
+
+// NewAuditChain creates an audit chain writing to index. Without a key, records are hashed but not signed.
+func NewAuditChain(esClient *elasticsearch.Client, index string, key []byte) *AuditChain {
+	return &AuditChain{
+		esClient: esClient,
+		index:    index,
+		key:      key,
+		chains:   make(map[string]*chainState),
+	}
+}
+
+// AuditChainProperties returns the mappings of the chain fields, to merge into the index mappings
+func AuditChainProperties() map[string]interface{} {
+	keyword := map[string]interface{}{"type": "keyword"}
+	return map[string]interface{}{
+		chainIDField:  keyword,
+		sequenceField: map[string]interface{}{"type": "long"},
+		prevHashField: keyword,
+		hashField:     keyword,
+		hmacField:     keyword,
+	}
+}
+
+// EnsureMappings creates the chain index with the mappings of AuditChainProperties, or adds them
+// to an existing index. It fails when the index maps the chain fields differently, e.g. as text
+// from dynamic mapping, because chains cannot be found or verified in such an index.
+func (c *AuditChain) EnsureMappings(ctx context.Context) error {
+	mappings := map[string]interface{}{"properties": AuditChainProperties()}
+	exists, err := NewIndexManager(c.esClient).indexExists(ctx, c.index)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		body, err := helpers.MapToReader(map[string]interface{}{"mappings": mappings})
+		if err != nil {
+			return err
+		}
+		res, err := c.esClient.Indices.Create(c.index,
+			c.esClient.Indices.Create.WithBody(body),
+			c.esClient.Indices.Create.WithContext(ctx),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create audit chain index %s: %w", c.index, err)
+		}
+		defer res.Body.Close()
+		if !res.IsError() {
+			log.Printf("Audit chain index %s created", c.index)
+			return nil
+		}
+		if res.StatusCode != http.StatusBadRequest {
+			return responseError(res, "create audit chain index "+c.index)
+		}
+		// Created concurrently; check its mappings below
+	}
+
+	body, err := helpers.MapToReader(mappings)
+	if err != nil {
+		return err
+	}
+	res, err := c.esClient.Indices.PutMapping([]string{c.index}, body, c.esClient.Indices.PutMapping.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to update mappings of audit chain index %s: %w", c.index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("audit chain index %s has incompatible chain field mappings, create it with AuditChainProperties: %w", c.index, helpers.NewElasticsearchError(res))
+	}
+	return nil
+}
+
+// ChainID returns the chain of a resource within an organization
+func ChainID(organizationID *int, resource string) string {
+	if organizationID == nil {
+		return "global:" + resource
+	}
+	return strconv.Itoa(*organizationID) + ":" + resource
+}
+
+// Append adds a document to the end of a chain and returns its link
+func (c *AuditChain) Append(ctx context.Context, chainID string, document interface{}) (*ChainLink, error) {
+	fields, err := canonicalFields(document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert audit document: %w", err)
+	}
+
+	state := c.chain(chainID)
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	head := state.head
+	if head == nil {
+		if head, err = c.latestLink(ctx, chainID); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; attempt < maxChainAppend; attempt++ {
+		link := &ChainLink{ChainID: chainID, Sequence: 1}
+		if head != nil {
+			link.Sequence = head.Sequence + 1
+			link.PrevHash = head.Hash
+		}
+
+		fields[chainIDField] = link.ChainID
+		fields[sequenceField] = link.Sequence
+		fields[prevHashField] = link.PrevHash
+		delete(fields, hashField)
+		delete(fields, hmacField)
+
+		if link.Hash, err = hashFields(fields); err != nil {
+			return nil, err
+		}
+		fields[hashField] = link.Hash
+		if c.key != nil {
+			link.HMAC = c.sign(link.Hash)
+			fields[hmacField] = link.HMAC
+		}
+
+		created, err := c.create(ctx, chainDocumentID(chainID, link.Sequence), fields)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			state.head = link
+			return link, nil
+		}
+
+		// Another writer claimed this sequence; continue from its record, and keep it as the head
+		// so the next Append does not walk the same records again
+		if head, err = c.getLink(ctx, chainID, link.Sequence); err != nil {
+			return nil, err
+		}
+		state.head = head
+	}
+
+	// Other writers are far ahead; find the head again on the next Append
+	state.head = nil
+	return nil, fmt.Errorf("failed to append to audit chain %s after %d attempts", chainID, maxChainAppend)
+}
+
+// Verify walks a chain in sequence order and reports gaps, broken links and modified records.
+// Deleting the newest records cannot be detected from the chain alone; compare LastSequence
+// with an externally kept value, or verify from the process that wrote them.
+func (c *AuditChain) Verify(ctx context.Context, chainID string) (*ChainVerification, error) {
+	verification := &ChainVerification{ChainID: chainID}
+
+	search := helpers.NewSearch().
+		Query(helpers.Term(chainIDField, chainID)).
+		Sort(sequenceField, "asc")
+
+	var previous *ChainLink
+	for batch, err := range helpers.Iterate[map[string]interface{}](ctx, c.esClient, search, helpers.IterateOptions{Index: c.index}) {
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit chain %s: %w", chainID, err)
+		}
+		for _, hit := range batch {
+			link := c.verifyRecord(hit.ID, hit.Source, previous, verification)
+			verification.Records++
+			verification.LastSequence = link.Sequence
+			previous = link
+		}
+	}
+
+	state := c.chain(chainID)
+	state.mutex.Lock()
+	head := state.head
+	state.mutex.Unlock()
+	if head != nil && head.Sequence > verification.LastSequence {
+		verification.Issues = append(verification.Issues, ChainIssue{
+			Kind:     ChainIssueTruncated,
+			Sequence: verification.LastSequence + 1,
+			Detail:   fmt.Sprintf("chain ends at %d but %d was written", verification.LastSequence, head.Sequence),
+		})
+	}
+
+	if !verification.Valid() {
+		log.Printf("Audit chain %s has %d issues", chainID, len(verification.Issues))
+	}
+	return verification, nil
+}
+
+// verifyRecord checks one record against its hash and the previous record
+func (c *AuditChain) verifyRecord(documentID string, fields map[string]interface{}, previous *ChainLink, verification *ChainVerification) *ChainLink {
+	link := linkFromFields(fields)
+	report := func(kind, detail string) {
+		verification.Issues = append(verification.Issues, ChainIssue{Kind: kind, Sequence: link.Sequence, DocumentID: documentID, Detail: detail})
+	}
+
+	expected := int64(1)
+	expectedPrev := ""
+	if previous != nil {
+		expected = previous.Sequence + 1
+		expectedPrev = previous.Hash
+	}
+	switch {
+	case previous != nil && link.Sequence == previous.Sequence:
+		report(ChainIssueDuplicate, "sequence appears more than once")
+	case link.Sequence > expected:
+		report(ChainIssueGap, fmt.Sprintf("sequences %d to %d are missing", expected, link.Sequence-1))
+	case link.PrevHash != expectedPrev:
+		report(ChainIssueBrokenLink, "previous hash does not match the previous record")
+	}
+
+	delete(fields, hashField)
+	delete(fields, hmacField)
+	if hash, err := hashFields(fields); err != nil || hash != link.Hash {
+		report(ChainIssueModified, "record does not match its hash")
+	}
+	if c.key != nil && !hmac.Equal([]byte(c.sign(link.Hash)), []byte(link.HMAC)) {
+		report(ChainIssueInvalidHMAC, "hash is not signed with the chain key")
+	}
+	return link
+}
+
+// chain returns the state of a chain, creating it on first use
+func (c *AuditChain) chain(chainID string) *chainState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	state, exists := c.chains[chainID]
+	if !exists {
+		state = &chainState{}
+		c.chains[chainID] = state
+	}
+	return state
+}
+
+// latestLink finds the last record of a chain, or nil for a new chain. Search is near real-time,
+// so a newer record may exist; Append then moves forward when its create conflicts.
+func (c *AuditChain) latestLink(ctx context.Context, chainID string) (*ChainLink, error) {
+	body, err := helpers.NewSearch().
+		Query(helpers.Term(chainIDField, chainID)).
+		Sort(sequenceField, "desc").
+		Size(1).
+		Reader()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.esClient.Search(
+		c.esClient.Search.WithIndex(c.index),
+		c.esClient.Search.WithBody(body),
+		c.esClient.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find head of audit chain %s: %w", chainID, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil // Index not created yet
+	}
+
+	result, err := helpers.ParseSearchResult[map[string]interface{}](res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find head of audit chain %s: %w", chainID, err)
+	}
+	if len(result.Hits) == 0 {
+		return nil, nil
+	}
+	return linkFromFields(result.Hits[0].Source), nil
+}
+
+// getLink reads the link of a record by its sequence with a real-time get
+func (c *AuditChain) getLink(ctx context.Context, chainID string, sequence int64) (*ChainLink, error) {
+	res, err := c.esClient.Get(c.index, chainDocumentID(chainID, sequence), c.esClient.Get.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit record %d of chain %s: %w", sequence, chainID, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, helpers.NewElasticsearchError(res)
+	}
+
+	var document struct {
+		Source map[string]interface{} `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&document); err != nil {
+		return nil, fmt.Errorf("failed to decode audit record: %w", err)
+	}
+	return linkFromFields(document.Source), nil
+}
+
+// create indexes a document unless its ID exists; it reports false on a conflict
+func (c *AuditChain) create(ctx context.Context, documentID string, fields map[string]interface{}) (bool, error) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+
+	res, err := c.esClient.Index(
+		c.index,
+		bytes.NewReader(data),
+		c.esClient.Index.WithDocumentID(documentID),
+		c.esClient.Index.WithOpType("create"),
+		c.esClient.Index.WithContext(ctx),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to index audit record: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict {
+		return false, nil
+	}
+	if res.IsError() {
+		return false, helpers.NewElasticsearchError(res)
+	}
+	return true, nil
+}
+
+// sign returns the hex HMAC-SHA256 of a hash
+func (c *AuditChain) sign(hash string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chainDocumentID returns the document ID of a sequence, zero-padded so IDs sort in order
+func chainDocumentID(chainID string, sequence int64) string {
+	return fmt.Sprintf("%s:%012d", chainID, sequence)
+}
+
+// canonicalFields converts a document into a generic JSON object. Numbers are decoded as float64,
+// the same way stored records are read back, so the hash is computed over identical values.
+func canonicalFields(document interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, errors.New("audit document must be a JSON object")
+	}
+	return fields, nil
+}
+
+// hashFields returns the hex SHA-256 of the canonical JSON of fields; map keys are marshalled sorted
+func hashFields(fields map[string]interface{}) (string, error) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal audit record for hashing: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// linkFromFields reads the chain fields of a stored record
+func linkFromFields(fields map[string]interface{}) *ChainLink {
+	link := &ChainLink{}
+	link.ChainID, _ = fields[chainIDField].(string)
+	link.PrevHash, _ = fields[prevHashField].(string)
+	link.Hash, _ = fields[hashField].(string)
+	link.HMAC, _ = fields[hmacField].(string)
+	switch sequence := fields[sequenceField].(type) {
+	case float64:
+		link.Sequence = int64(sequence)
+	case json.Number:
+		link.Sequence, _ = sequence.Int64()
+	}
+	return link
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Change operations, as in JSON Patch
+const (
+	ChangeAdd     = "add"
+	ChangeRemove  = "remove"
+	ChangeReplace = "replace"
+)
+
+// FieldChange is one changed value between the old and new state of a resource
+type FieldChange struct {
+	Path     string      `json:"path"` // JSON pointer, e.g. "/details/2/discountPrice"
+	Op       string      `json:"op"`
+	OldValue interface{} `json:"oldValue,omitempty"`
+	NewValue interface{} `json:"newValue,omitempty"`
+}
+
+// arrayItemKeys are the fields used to match array items between old and new state,
+// so inserting an item is reported as one addition instead of a change to every later item
+var arrayItemKeys = []string{"id", "ID", "Id"}
+
+// DiffStates returns the field-level changes from oldState to newState.
+// Both are converted to their JSON form first, so structs, maps and raw JSON can be compared.
+func DiffStates(oldState, newState interface{}) ([]FieldChange, error) {
+	oldValue, err := toJSONValue(oldState)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert old state: %w", err)
+	}
+	newValue, err := toJSONValue(newState)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert new state: %w", err)
+	}
+
+	changes := []FieldChange{}
+	diffValues("", oldValue, newValue, &changes)
+	return changes, nil
+}
+
+// ChangedFields returns the distinct fields of changes as dotted paths without array indices,
+// e.g. "details.discountPrice", for term queries on audit records
+func ChangedFields(changes []FieldChange) []string {
+	seen := make(map[string]bool)
+	var fields []string
+	for _, change := range changes {
+		var parts []string
+		for _, token := range splitPointer(change.Path) {
+			if _, err := strconv.Atoi(token); err == nil {
+				continue
+			}
+			parts = append(parts, token)
+		}
+		field := strings.Join(parts, ".")
+		if field != "" && !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// toJSONValue converts a value into its generic JSON form, keeping numbers exact
+func toJSONValue(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	var data []byte
+	switch v := value.(type) {
+	case json.RawMessage:
+		data = v
+	case []byte:
+		data = v
+	default:
+		var err error
+		if data, err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var result interface{}
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// diffValues appends the changes between two JSON values at path
+func diffValues(path string, oldValue, newValue interface{}, changes *[]FieldChange) {
+	switch {
+	case oldValue == nil && newValue == nil:
+		return
+	case oldValue == nil:
+		*changes = append(*changes, FieldChange{Path: path, Op: ChangeAdd, NewValue: newValue})
+		return
+	case newValue == nil:
+		*changes = append(*changes, FieldChange{Path: path, Op: ChangeRemove, OldValue: oldValue})
+		return
+	}
+
+	oldObject, oldIsObject := oldValue.(map[string]interface{})
+	newObject, newIsObject := newValue.(map[string]interface{})
+	if oldIsObject && newIsObject {
+		diffObjects(path, oldObject, newObject, changes)
+		return
+	}
+
+	oldArray, oldIsArray := oldValue.([]interface{})
+	newArray, newIsArray := newValue.([]interface{})
+	if oldIsArray && newIsArray {
+		diffArrays(path, oldArray, newArray, changes)
+		return
+	}
+
+	if !reflect.DeepEqual(oldValue, newValue) {
+		*changes = append(*changes, FieldChange{Path: path, Op: ChangeReplace, OldValue: oldValue, NewValue: newValue})
+	}
+}
+
+// diffObjects compares objects key by key in sorted order, so changes are deterministic
+func diffObjects(path string, oldObject, newObject map[string]interface{}, changes *[]FieldChange) {
+	keys := make([]string, 0, len(oldObject)+len(newObject))
+	for key := range oldObject {
+		keys = append(keys, key)
+	}
+	for key := range newObject {
+		if _, exists := oldObject[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		diffValues(path+"/"+escapePointer(key), oldObject[key], newObject[key], changes)
+	}
+}
+
+// diffArrays matches items by their ID when they have one and by position otherwise.
+// Removed items are reported at their old index, added and changed items at their new index.
+func diffArrays(path string, oldArray, newArray []interface{}, changes *[]FieldChange) {
+	key := arrayItemKey(oldArray, newArray)
+	if key == "" {
+		if allScalars(oldArray) && allScalars(newArray) {
+			diffScalarArrays(path, oldArray, newArray, changes)
+		} else {
+			diffArraysByPosition(path, oldArray, newArray, changes)
+		}
+		return
+	}
+
+	oldIndex := make(map[string]int, len(oldArray))
+	for i, item := range oldArray {
+		oldIndex[itemKey(item, key)] = i
+	}
+	newKeys := make(map[string]bool, len(newArray))
+	for _, item := range newArray {
+		newKeys[itemKey(item, key)] = true
+	}
+
+	for i, item := range oldArray {
+		if !newKeys[itemKey(item, key)] {
+			*changes = append(*changes, FieldChange{Path: fmt.Sprintf("%s/%d", path, i), Op: ChangeRemove, OldValue: item})
+		}
+	}
+	for i, item := range newArray {
+		itemPath := fmt.Sprintf("%s/%d", path, i)
+		if j, exists := oldIndex[itemKey(item, key)]; exists {
+			diffValues(itemPath, oldArray[j], item, changes)
+		} else {
+			*changes = append(*changes, FieldChange{Path: itemPath, Op: ChangeAdd, NewValue: item})
+		}
+	}
+}
+
+// diffScalarArrays reports values removed from and added to arrays of scalars such as tags,
+// ignoring items that only moved
+func diffScalarArrays(path string, oldArray, newArray []interface{}, changes *[]FieldChange) {
+	remaining := make(map[string]int, len(newArray))
+	for _, item := range newArray {
+		remaining[scalarKey(item)]++
+	}
+	for i, item := range oldArray {
+		if remaining[scalarKey(item)] > 0 {
+			remaining[scalarKey(item)]--
+			continue
+		}
+		*changes = append(*changes, FieldChange{Path: fmt.Sprintf("%s/%d", path, i), Op: ChangeRemove, OldValue: item})
+	}
+
+	previous := make(map[string]int, len(oldArray))
+	for _, item := range oldArray {
+		previous[scalarKey(item)]++
+	}
+	for i, item := range newArray {
+		if previous[scalarKey(item)] > 0 {
+			previous[scalarKey(item)]--
+			continue
+		}
+		*changes = append(*changes, FieldChange{Path: fmt.Sprintf("%s/%d", path, i), Op: ChangeAdd, NewValue: item})
+	}
+}
+
+// scalarKey identifies a scalar by type and value, so "1" and 1 differ
+func scalarKey(item interface{}) string {
+	return fmt.Sprintf("%T:%v", item, item)
+}
+
+// allScalars reports whether no item is an object or array
+func allScalars(items []interface{}) bool {
+	for _, item := range items {
+		switch item.(type) {
+		case map[string]interface{}, []interface{}:
+			return false
+		}
+	}
+	return true
+}
+
+// diffArraysByPosition compares items at the same index; extra items are added or removed
+func diffArraysByPosition(path string, oldArray, newArray []interface{}, changes *[]FieldChange) {
+	for i := 0; i < len(oldArray) || i < len(newArray); i++ {
+		itemPath := fmt.Sprintf("%s/%d", path, i)
+		switch {
+		case i >= len(newArray):
+			*changes = append(*changes, FieldChange{Path: itemPath, Op: ChangeRemove, OldValue: oldArray[i]})
+		case i >= len(oldArray):
+			*changes = append(*changes, FieldChange{Path: itemPath, Op: ChangeAdd, NewValue: newArray[i]})
+		default:
+			diffValues(itemPath, oldArray[i], newArray[i], changes)
+		}
+	}
+}
+
+// arrayItemKey returns the ID field present and unique in every item of both arrays, or "" when there is none
+func arrayItemKey(oldArray, newArray []interface{}) string {
+	if len(oldArray) == 0 && len(newArray) == 0 {
+		return ""
+	}
+
+	for _, key := range arrayItemKeys {
+		if hasUniqueKey(oldArray, key) && hasUniqueKey(newArray, key) {
+			return key
+		}
+	}
+	return ""
+}
+
+// hasUniqueKey reports whether every item is an object with a distinct value for key
+func hasUniqueKey(items []interface{}, key string) bool {
+	ids := make(map[string]bool, len(items))
+	for _, item := range items {
+		object, ok := item.(map[string]interface{})
+		if !ok || object[key] == nil {
+			return false
+		}
+		id := itemKey(item, key)
+		if ids[id] {
+			return false
+		}
+		ids[id] = true
+	}
+	return true
+}
+
+// itemKey returns the ID of an array item as a string
+func itemKey(item interface{}, key string) string {
+	return fmt.Sprint(item.(map[string]interface{})[key])
+}
+
+// escapePointer escapes a key for use as a JSON pointer token
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// splitPointer splits a JSON pointer into unescaped tokens
+func splitPointer(pointer string) []string {
+	if pointer == "" {
+		return nil
+	}
+	tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens
+}
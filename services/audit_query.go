@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/NHadi/AmanahPro-common/helpers"
+)
+
+// ErrNoAuditSnapshot is returned by StateAt when the audit record has no stored snapshot
+var ErrNoAuditSnapshot = errors.New("audit record has no snapshot")
+
+// ErrNoAuditRecord is returned by StateAt when no record exists at or before the requested time
+var ErrNoAuditRecord = errors.New("no audit record found")
+
+// AuditQuery filters and paginates audit records. Records are returned newest first.
+type AuditQuery struct {
+	From    time.Time // Inclusive; zero for no lower bound
+	To      time.Time // Exclusive; zero for no upper bound
+	Actions []string
+	Page    int // 1-based, default 1
+	PerPage int // Default 50
+	// Cursor continues after the last record of a previous page instead of using Page,
+	// for paging beyond 10,000 records
+	Cursor []interface{}
+}
+
+// AuditPage is one page of audit records
+type AuditPage struct {
+	Records    []AuditRecord
+	Total      int64
+	Page       int
+	PerPage    int
+	NextCursor []interface{} // Pass as Cursor for the next page; nil on the last page
+}
+
+// ResourceHistory returns the records of one resource
+func (a *AuditTrailService) ResourceHistory(ctx context.Context, resource string, resourceID interface{}, query AuditQuery) (*AuditPage, error) {
+	return a.searchRecords(ctx, query,
+		helpers.Term("resource", resource),
+		helpers.Term("resourceId", formatResourceID(resourceID)),
+	)
+}
+
+// UserActivity returns the records of actions by one user
+func (a *AuditTrailService) UserActivity(ctx context.Context, userID int, query AuditQuery) (*AuditPage, error) {
+	return a.searchRecords(ctx, query, helpers.Term("userId", userID))
+}
+
+// OrganizationActivity returns the records of one organization, typically within query.From and query.To
+func (a *AuditTrailService) OrganizationActivity(ctx context.Context, organizationID int, query AuditQuery) (*AuditPage, error) {
+	return a.searchRecords(ctx, query, helpers.Term("organizationId", organizationID))
+}
+
+// StateAt returns the state of a resource as of at, from the snapshot of the last record at or
+// before that time. The state is nil when the resource was deleted by that record.
+func (a *AuditTrailService) StateAt(ctx context.Context, resource string, resourceID interface{}, at time.Time) (json.RawMessage, *AuditRecord, error) {
+	page, err := a.searchRecords(ctx, AuditQuery{To: at.Add(time.Nanosecond), PerPage: 1},
+		helpers.Term("resource", resource),
+		helpers.Term("resourceId", formatResourceID(resourceID)),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(page.Records) == 0 {
+		return nil, nil, ErrNoAuditRecord
+	}
+
+	record := &page.Records[0]
+	switch {
+	case record.NewData != nil:
+		state, err := json.Marshal(record.NewData)
+		if err != nil {
+			return nil, record, fmt.Errorf("failed to marshal audit snapshot: %w", err)
+		}
+		return state, record, nil
+	case record.OldData != nil:
+		return nil, record, nil // Deleted
+	default:
+		return nil, record, ErrNoAuditSnapshot
+	}
+}
+
+// AuditStateAt returns the state of a resource as of at, decoded into T; see StateAt
+func AuditStateAt[T any](ctx context.Context, a *AuditTrailService, resource string, resourceID interface{}, at time.Time) (*T, *AuditRecord, error) {
+	state, record, err := a.StateAt(ctx, resource, resourceID, at)
+	if err != nil || state == nil {
+		return nil, record, err
+	}
+
+	var value T
+	if err := json.Unmarshal(state, &value); err != nil {
+		return nil, record, fmt.Errorf("failed to decode audit snapshot: %w", err)
+	}
+	return &value, record, nil
+}
+
+// searchRecords runs a filtered, paginated search on the audit index
+func (a *AuditTrailService) searchRecords(ctx context.Context, query AuditQuery, filters ...helpers.Query) (*AuditPage, error) {
+	if query.Page < 1 {
+		query.Page = 1
+	}
+	if query.PerPage <= 0 {
+		query.PerPage = 50
+	}
+
+	if !query.From.IsZero() || !query.To.IsZero() {
+		timeRange := helpers.Range("timestamp")
+		if !query.From.IsZero() {
+			timeRange.Gte(query.From.UTC().Format(time.RFC3339Nano))
+		}
+		if !query.To.IsZero() {
+			timeRange.Lt(query.To.UTC().Format(time.RFC3339Nano))
+		}
+		filters = append(filters, timeRange)
+	}
+	if len(query.Actions) > 0 {
+		actions := make([]interface{}, 0, len(query.Actions))
+		for _, action := range query.Actions {
+			actions = append(actions, action)
+		}
+		filters = append(filters, helpers.Terms("action", actions...))
+	}
+
+	search := helpers.NewSearch().
+		Scope(filters...).
+		Sort("timestamp", "desc").
+		Sort("id", "asc").
+		Size(query.PerPage).
+		TrackTotalHits()
+
+	body := search.Build()
+	if query.Cursor != nil {
+		body["search_after"] = query.Cursor
+	} else {
+		body["from"] = (query.Page - 1) * query.PerPage
+	}
+	reader, err := helpers.MapToReader(body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := a.esClient.Search(
+		a.esClient.Search.WithIndex(a.index),
+		a.esClient.Search.WithBody(reader),
+		a.esClient.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search audit trail: %w", err)
+	}
+	defer res.Body.Close()
+
+	result, err := helpers.ParseSearchResult[AuditRecord](res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search audit trail: %w", err)
+	}
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("failed to decode audit records: %w", err)
+	}
+
+	page := &AuditPage{
+		Records: result.Items(),
+		Total:   result.Total,
+		Page:    query.Page,
+		PerPage: query.PerPage,
+	}
+	if len(result.Hits) == query.PerPage {
+		page.NextCursor = result.LastSort()
+	}
+	return page, nil
+}
@@ -6,52 +6,284 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/NHadi/AmanahPro-common/helpers"
+	"github.com/NHadi/AmanahPro-common/models"
 	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/google/uuid"
 )
 
+// AuditRecord is one audited action on a resource
+type AuditRecord struct {
+	ID             string        `json:"id"`
+	TraceID        string        `json:"traceId,omitempty"`
+	Action         string        `json:"action"`
+	Resource       string        `json:"resource"`
+	ResourceID     string        `json:"resourceId"`
+	UserID         int           `json:"userId"`
+	Username       string        `json:"username,omitempty"`
+	OrganizationID *int          `json:"organizationId,omitempty"`
+	IPAddress      string        `json:"ipAddress,omitempty"`
+	UserAgent      string        `json:"userAgent,omitempty"`
+	Changes        []FieldChange `json:"changes"`
+	ChangedFields  []string      `json:"changedFields"`
+	NewData        interface{}   `json:"newData,omitempty"` // Full snapshots, unless disabled with SetStoreSnapshots
+	OldData        interface{}   `json:"oldData,omitempty"`
+	Request        *AuditRequest `json:"request,omitempty"` // Set for records of HTTP requests
+	Timestamp      time.Time     `json:"timestamp"`
+	*ChainLink                   // Set when the hash chain is enabled
+}
+
+// AuditRequest is the HTTP request that caused an audited action
+type AuditRequest struct {
+	Method       string            `json:"method"`
+	Route        string            `json:"route"` // Route pattern, e.g. "/projects/:id"
+	Path         string            `json:"path"`
+	Params       map[string]string `json:"params,omitempty"`
+	Status       int               `json:"status"`
+	Body         interface{}       `json:"body,omitempty"` // Redacted JSON bodies
+	ResponseBody interface{}       `json:"responseBody,omitempty"`
+}
+
+// AuditEntry describes an action to audit
+type AuditEntry struct {
+	TraceID    string
+	Action     string
+	Resource   string
+	ResourceID interface{}
+	Claims     *models.JWTClaims // Actor and organization; UserID is used when nil
+	UserID     int
+	IPAddress  string
+	UserAgent  string
+	OldData    interface{}
+	NewData    interface{}
+	Request    *AuditRequest
+}
+
 type AuditTrailService struct {
-	esClient *elasticsearch.Client
-	index    string
+	esClient       *elasticsearch.Client
+	index          string
+	storeSnapshots bool
+	chain          *AuditChain
+	writer         *AuditWriter
 }
 
 // NewAuditTrailService initializes a new AuditTrailService
 func NewAuditTrailService(esClient *elasticsearch.Client, index string) *AuditTrailService {
 	return &AuditTrailService{
-		esClient: esClient,
-		index:    index,
+		esClient:       esClient,
+		index:          index,
+		storeSnapshots: true,
+	}
+}
+
+// SetStoreSnapshots sets whether records keep the full old and new data next to the changes
+func (a *AuditTrailService) SetStoreSnapshots(store bool) {
+	a.storeSnapshots = store
+}
+
+// EnableHashChain appends records to a hash chain per organization and resource,
+// so later edits or deletions are detected by AuditChain.Verify
+func (a *AuditTrailService) EnableHashChain(chain *AuditChain) {
+	a.chain = chain
+}
+
+// EnableAsync writes records in the background through an AuditWriter, so a slow or unavailable
+// cluster does not delay callers. Chained records are still written synchronously.
+func (a *AuditTrailService) EnableAsync(config AuditWriterConfig) error {
+	writer, err := NewAuditWriter(a.esClient, a.index, config)
+	if err != nil {
+		return err
+	}
+	a.writer = writer
+	return nil
+}
+
+// Close flushes records queued by the async writer; call it on shutdown
+func (a *AuditTrailService) Close(ctx context.Context) error {
+	if a.writer == nil {
+		return nil
+	}
+	return a.writer.Close(ctx)
+}
+
+// AuditIndexDefinition returns the mappings of the audit index. Changed values and snapshots
+// differ in type between resources, so they are stored but not indexed. Timestamps are mapped
+// with nanosecond precision; migrate indices created with a "date" mapping to a new version.
+func AuditIndexDefinition(name string, version int) IndexDefinition {
+	unindexed := map[string]interface{}{"type": "object", "enabled": false}
+	keyword := map[string]interface{}{"type": "keyword"}
+
+	properties := AuditChainProperties()
+	for field, mapping := range map[string]interface{}{
+		"id":             keyword,
+		"traceId":        keyword,
+		"action":         keyword,
+		"resource":       keyword,
+		"resourceId":     keyword,
+		"userId":         map[string]interface{}{"type": "integer"},
+		"username":       keyword,
+		"organizationId": map[string]interface{}{"type": "integer"},
+		"ipAddress":      keyword,
+		"userAgent":      keyword,
+		"changedFields":  keyword,
+		"changes": map[string]interface{}{
+			"type": "nested",
+			"properties": map[string]interface{}{
+				"path":     keyword,
+				"op":       keyword,
+				"oldValue": unindexed,
+				"newValue": unindexed,
+			},
+		},
+		"request": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"method":       keyword,
+				"route":        keyword,
+				"path":         keyword,
+				"params":       map[string]interface{}{"type": "flattened"},
+				"status":       map[string]interface{}{"type": "integer"},
+				"body":         unindexed,
+				"responseBody": unindexed,
+			},
+		},
+		"newData":   unindexed,
+		"oldData":   unindexed,
+		"timestamp": map[string]interface{}{"type": "date_nanos"}, // Orders records within the same millisecond
+	} {
+		properties[field] = mapping
+	}
+
+	return IndexDefinition{
+		Name:     name,
+		Version:  version,
+		Mappings: map[string]interface{}{"properties": properties},
 	}
 }
 
 // LogAction logs an audit trail action
 func (a *AuditTrailService) LogAction(traceID, action, resource string, resourceID interface{}, userID int, newData, oldData interface{}) error {
-	auditLog := map[string]interface{}{
-		"traceId":    traceID,
-		"action":     action,
-		"resource":   resource,
-		"resourceId": resourceID,
-		"userId":     userID,
-		"newData":    newData,
-		"oldData":    oldData,
-		"timestamp":  time.Now().Format(time.RFC3339),
-	}
-
-	data, err := json.Marshal(auditLog)
+	_, err := a.Record(context.Background(), AuditEntry{
+		TraceID:    traceID,
+		Action:     action,
+		Resource:   resource,
+		ResourceID: resourceID,
+		UserID:     userID,
+		NewData:    newData,
+		OldData:    oldData,
+	})
+	return err
+}
+
+// Record computes the field-level changes of an entry and stores it as an AuditRecord
+func (a *AuditTrailService) Record(ctx context.Context, entry AuditEntry) (*AuditRecord, error) {
+	record, err := a.NewRecord(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.chain != nil {
+		link, err := a.chain.Append(ctx, ChainID(record.OrganizationID, record.Resource), record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to append audit log to chain: %w", err)
+		}
+		record.ChainLink = link
+		log.Printf("Audit trail logged: %s %s/%s by user %d (chain %s #%d)", record.Action, record.Resource, record.ResourceID, record.UserID, link.ChainID, link.Sequence)
+		return record, nil
+	}
+
+	if a.writer != nil {
+		if err := a.writer.Write(record); err != nil {
+			return nil, fmt.Errorf("failed to queue audit log: %w", err)
+		}
+		return record, nil
+	}
+
+	data, err := json.Marshal(record)
 	if err != nil {
-		return fmt.Errorf("failed to marshal audit log: %w", err)
+		return nil, fmt.Errorf("failed to marshal audit log: %w", err)
 	}
 
 	res, err := a.esClient.Index(
 		a.index,
 		bytes.NewReader(data),
-		a.esClient.Index.WithContext(context.Background()),
+		a.esClient.Index.WithDocumentID(record.ID),
+		a.esClient.Index.WithContext(ctx),
 	)
 	if err != nil {
-		return fmt.Errorf("failed to index audit log: %w", err)
+		return nil, fmt.Errorf("failed to index audit log: %w", err)
 	}
 	defer res.Body.Close()
 
-	log.Printf("Audit trail logged: %+v", auditLog)
-	return nil
+	if res.IsError() {
+		return nil, fmt.Errorf("failed to index audit log: %w", helpers.NewElasticsearchError(res))
+	}
+
+	log.Printf("Audit trail logged: %s %s/%s by user %d (%d changes)", record.Action, record.Resource, record.ResourceID, record.UserID, len(record.Changes))
+	return record, nil
+}
+
+// NewRecord builds the audit record of an entry without storing it
+func (a *AuditTrailService) NewRecord(entry AuditEntry) (*AuditRecord, error) {
+	changes, err := DiffStates(entry.OldData, entry.NewData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff audit data: %w", err)
+	}
+
+	record := &AuditRecord{
+		ID:            uuid.NewString(),
+		TraceID:       entry.TraceID,
+		Action:        entry.Action,
+		Resource:      entry.Resource,
+		ResourceID:    formatResourceID(entry.ResourceID),
+		UserID:        entry.UserID,
+		IPAddress:     entry.IPAddress,
+		UserAgent:     entry.UserAgent,
+		Request:       entry.Request,
+		Changes:       changes,
+		ChangedFields: ChangedFields(changes),
+		Timestamp:     nextAuditTimestamp(),
+	}
+	if entry.Claims != nil {
+		record.UserID = entry.Claims.UserID
+		record.Username = entry.Claims.Username
+		record.OrganizationID = entry.Claims.OrganizationId
+	}
+	if a.storeSnapshots {
+		record.NewData = entry.NewData
+		record.OldData = entry.OldData
+	}
+	return record, nil
+}
+
+var (
+	lastAuditTimestamp time.Time
+	auditTimestampLock sync.Mutex
+)
+
+// nextAuditTimestamp returns the current time, moved forward when needed so records of this
+// process get strictly increasing timestamps and StateAt never has to break a tie
+func nextAuditTimestamp() time.Time {
+	auditTimestampLock.Lock()
+	defer auditTimestampLock.Unlock()
+
+	now := time.Now().UTC()
+	if !now.After(lastAuditTimestamp) {
+		now = lastAuditTimestamp.Add(time.Nanosecond)
+	}
+	lastAuditTimestamp = now
+	return now
+}
+
+// formatResourceID converts a resource ID into a string without float formatting
+func formatResourceID(resourceID interface{}) string {
+	if resourceID == nil {
+		return ""
+	}
+	if id, err := formatID(resourceID); err == nil {
+		return id
+	}
+	return fmt.Sprint(resourceID)
 }
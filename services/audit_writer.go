@@ -0,0 +1,435 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHadi/AmanahPro-common/helpers"
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// ErrAuditBufferFull is returned by Write when the buffer is full and no spool directory is configured
+var ErrAuditBufferFull = errors.New("audit buffer full")
+
+// ErrAuditWriterClosed is returned by Write after Close
+var ErrAuditWriterClosed = errors.New("audit writer closed")
+
+// AuditWriterConfig controls buffering, flushing and spooling of the async audit writer
+type AuditWriterConfig struct {
+	BufferSize     int           // Records waiting to be flushed before Write spills to the spool
+	FlushSize      int           // Flush after this many records
+	FlushInterval  time.Duration // Flush buffered records at least this often
+	SpoolDir       string        // Directory for records that could not be written; empty disables spooling
+	ReplayInterval time.Duration // How often spooled records are retried
+	WriteTimeout   time.Duration // Bulk requests taking longer are treated as failed and spooled
+}
+
+// DefaultAuditWriterConfig returns a config flushing every 500 records or second
+func DefaultAuditWriterConfig() AuditWriterConfig {
+	return AuditWriterConfig{
+		BufferSize:     10000,
+		FlushSize:      500,
+		FlushInterval:  time.Second,
+		ReplayInterval: 30 * time.Second,
+		WriteTimeout:   10 * time.Second,
+	}
+}
+
+// spooledRecord is a marshalled audit record waiting to be written
+type spooledRecord struct {
+	id   string
+	body []byte
+}
+
+// AuditWriter writes audit records to Elasticsearch in the background with bulk requests.
+// Batches that fail because Elasticsearch is unavailable are spooled to disk and replayed once
+// it recovers; records Elasticsearch rejects are kept in "rejected-*" spool files for inspection.
+type AuditWriter struct {
+	esClient  *elasticsearch.Client
+	index     string
+	config    AuditWriterConfig
+	records   chan spooledRecord
+	closing   chan struct{}
+	closeCtx  context.Context // Bounds the final flush; set by Close
+	closed    bool
+	done      chan struct{}
+	mutex     sync.RWMutex // Held by Write while queueing, so no record is queued after Close
+	spoolLock sync.Mutex
+}
+
+// NewAuditWriter creates the spool directory if configured and starts the flush loop
+func NewAuditWriter(esClient *elasticsearch.Client, index string, config AuditWriterConfig) (*AuditWriter, error) {
+	defaults := DefaultAuditWriterConfig()
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaults.BufferSize
+	}
+	if config.FlushSize <= 0 {
+		config.FlushSize = defaults.FlushSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaults.FlushInterval
+	}
+	if config.ReplayInterval <= 0 {
+		config.ReplayInterval = defaults.ReplayInterval
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = defaults.WriteTimeout
+	}
+	if config.SpoolDir != "" {
+		if err := os.MkdirAll(config.SpoolDir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create audit spool directory: %w", err)
+		}
+	}
+
+	writer := &AuditWriter{
+		esClient: esClient,
+		index:    index,
+		config:   config,
+		records:  make(chan spooledRecord, config.BufferSize),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go writer.run()
+	return writer, nil
+}
+
+// Write queues a record without waiting for Elasticsearch. When the buffer is full the record
+// is spooled to disk, or ErrAuditBufferFull is returned without a spool directory.
+func (w *AuditWriter) Write(record *AuditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit log: %w", err)
+	}
+	item := spooledRecord{id: record.ID, body: body}
+
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if w.closed {
+		return ErrAuditWriterClosed
+	}
+
+	select {
+	case w.records <- item:
+		return nil
+	default:
+	}
+
+	if w.config.SpoolDir == "" {
+		return ErrAuditBufferFull
+	}
+	log.Printf("Audit buffer full, spooling record %s", record.ID)
+	return w.spool("", []spooledRecord{item})
+}
+
+// Close flushes buffered records and stops the writer. Records that cannot be written before ctx
+// is done are spooled, so Close returns once the remaining records are written or on disk.
+func (w *AuditWriter) Close(ctx context.Context) error {
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		w.closeCtx = ctx
+		close(w.closing)
+	}
+	w.mutex.Unlock()
+
+	<-w.done
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("timed out flushing audit writer, remaining records were spooled: %w", err)
+	}
+	return nil
+}
+
+func (w *AuditWriter) run() {
+	defer close(w.done)
+
+	// Spooled records are replayed in their own goroutine, so a slow replay does not hold up flushing
+	replayDone := make(chan struct{})
+	go w.replayLoop(replayDone)
+	defer func() { <-replayDone }()
+
+	flushTicker := time.NewTicker(w.config.FlushInterval)
+	defer flushTicker.Stop()
+
+	var batch []spooledRecord
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		w.writeOrSpool(ctx, batch)
+		batch = nil
+	}
+
+	for {
+		select {
+		case record := <-w.records:
+			batch = append(batch, record)
+			if len(batch) >= w.config.FlushSize {
+				flush(context.Background())
+			}
+		case <-flushTicker.C:
+			flush(context.Background())
+		case <-w.closing:
+			// Drain records queued before Close; Write queues nothing after closing is closed
+			w.mutex.RLock()
+			ctx := w.closeCtx
+			w.mutex.RUnlock()
+			for {
+				select {
+				case record := <-w.records:
+					batch = append(batch, record)
+					if len(batch) >= w.config.FlushSize {
+						flush(ctx)
+					}
+				default:
+					flush(ctx)
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeOrSpool writes a batch and spools the records that could not be written
+func (w *AuditWriter) writeOrSpool(ctx context.Context, batch []spooledRecord) {
+	retry, rejected, err := w.bulkWrite(ctx, batch)
+	if err != nil {
+		log.Printf("Failed to write %d audit records: %v", len(batch), err)
+	}
+	if len(retry) > 0 {
+		if err := w.spool("", retry); err != nil {
+			log.Printf("Failed to spool %d audit records, they are lost: %v", len(retry), err)
+		}
+	}
+	if len(rejected) > 0 {
+		if err := w.spool("rejected-", rejected); err != nil {
+			log.Printf("Failed to spool %d rejected audit records: %v", len(rejected), err)
+		}
+	}
+}
+
+// bulkWrite sends a batch with create actions, so replayed records are not written twice.
+// It returns the records to retry later and the records Elasticsearch rejected. The request is
+// bounded by WriteTimeout, so a hung cluster fails the batch instead of blocking the writer.
+func (w *AuditWriter) bulkWrite(ctx context.Context, batch []spooledRecord) (retry, rejected []spooledRecord, err error) {
+	ctx, cancel := context.WithTimeout(ctx, w.config.WriteTimeout)
+	defer cancel()
+
+	var body bytes.Buffer
+	items := make([]BulkItem, 0, len(batch))
+	for _, record := range batch {
+		item := BulkItem{Action: BulkActionCreate, Index: w.index, DocumentID: record.id, Body: record.body}
+		if err := writeBulkItem(&body, item); err != nil {
+			return batch, nil, err
+		}
+		items = append(items, item)
+	}
+
+	res, err := w.esClient.Bulk(
+		bytes.NewReader(body.Bytes()),
+		w.esClient.Bulk.WithContext(ctx),
+	)
+	if err != nil {
+		return batch, rejected, fmt.Errorf("failed to execute bulk request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		esErr := helpers.NewElasticsearchError(res)
+		if isRetryableStatus(res.StatusCode) {
+			return batch, rejected, esErr
+		}
+		return nil, append(rejected, batch...), esErr
+	}
+
+	var response struct {
+		Items []map[string]bulkResponseItem `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return batch, rejected, fmt.Errorf("failed to decode bulk response: %w", err)
+	}
+	if len(response.Items) != len(items) {
+		return batch, rejected, fmt.Errorf("bulk response has %d items, expected %d", len(response.Items), len(items))
+	}
+
+	for i, item := range items {
+		itemErr := bulkItemResult(item, response.Items[i])
+		var bulkErr *BulkItemError
+		switch {
+		case itemErr == nil:
+		case errors.As(itemErr, &bulkErr) && bulkErr.Status == http.StatusConflict:
+			// Written before, e.g. by an earlier replay
+		case errors.As(itemErr, &bulkErr) && !isRetryableStatus(bulkErr.Status):
+			log.Printf("Audit record %s rejected: %v", item.DocumentID, itemErr)
+			rejected = append(rejected, spooledRecord{id: item.DocumentID, body: item.Body})
+		default:
+			retry = append(retry, spooledRecord{id: item.DocumentID, body: item.Body})
+		}
+	}
+	if len(retry) > 0 {
+		err = fmt.Errorf("%d audit records failed temporarily", len(retry))
+	}
+	return retry, rejected, err
+}
+
+// isRetryableStatus reports whether a status is expected to succeed later
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// spool writes records to a new JSON lines file, atomically through a temporary file
+func (w *AuditWriter) spool(prefix string, records []spooledRecord) error {
+	if w.config.SpoolDir == "" {
+		return errors.New("no spool directory configured")
+	}
+
+	w.spoolLock.Lock()
+	defer w.spoolLock.Unlock()
+
+	tmp, err := os.CreateTemp(w.config.SpoolDir, ".audit-*")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for _, record := range records {
+		writer.Write(record.body)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write spool file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync spool file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close spool file: %w", err)
+	}
+
+	name := fmt.Sprintf("%s%020d.jsonl", prefix, time.Now().UnixNano())
+	return os.Rename(tmp.Name(), filepath.Join(w.config.SpoolDir, name))
+}
+
+// replayLoop replays spooled files at startup and every ReplayInterval until the writer is closed.
+// Replays run one at a time; a replay in progress is cancelled by Close and resumed on the next start.
+func (w *AuditWriter) replayLoop(done chan struct{}) {
+	defer close(done)
+	if w.config.SpoolDir == "" {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-w.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(w.config.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		w.replay(ctx)
+		select {
+		case <-ticker.C:
+		case <-w.closing:
+			return
+		}
+	}
+}
+
+// replay writes spooled files oldest first and stops at the first file that still fails
+func (w *AuditWriter) replay(ctx context.Context) {
+	for _, path := range w.spoolFiles() {
+		if ctx.Err() != nil {
+			return // Replayed on the next start
+		}
+
+		records, err := readSpoolFile(path)
+		if err != nil {
+			log.Printf("Failed to read audit spool file %s: %v", path, err)
+			continue
+		}
+
+		retry, rejected, err := w.bulkWrite(ctx, records)
+		if len(retry) > 0 {
+			log.Printf("Audit spool replay paused, %d records still failing: %v", len(retry), err)
+			return
+		}
+		if len(rejected) > 0 {
+			if err := w.spool("rejected-", rejected); err != nil {
+				log.Printf("Failed to spool %d rejected audit records: %v", len(rejected), err)
+				return
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove audit spool file %s: %v", path, err)
+			return
+		}
+		log.Printf("Replayed %d spooled audit records from %s", len(records), filepath.Base(path))
+	}
+}
+
+// spoolFiles returns the replayable spool files, oldest first
+func (w *AuditWriter) spoolFiles() []string {
+	w.spoolLock.Lock()
+	defer w.spoolLock.Unlock()
+
+	entries, err := os.ReadDir(w.config.SpoolDir)
+	if err != nil {
+		log.Printf("Failed to read audit spool directory: %v", err)
+		return nil
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "rejected-") || !strings.HasSuffix(name, ".jsonl") {
+			continue
+		}
+		paths = append(paths, filepath.Join(w.config.SpoolDir, name))
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// readSpoolFile loads the records of a spool file
+func readSpoolFile(path string) ([]spooledRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []spooledRecord
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var header struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(line, &header); err != nil {
+			return nil, fmt.Errorf("failed to parse spooled record: %w", err)
+		}
+		records = append(records, spooledRecord{id: header.ID, body: append([]byte(nil), line...)})
+	}
+	return records, nil
+}
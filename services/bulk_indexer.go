@@ -0,0 +1,329 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// Bulk actions
+const (
+	BulkActionIndex  = "index"
+	BulkActionCreate = "create"
+	BulkActionUpdate = "update"
+	BulkActionDelete = "delete"
+)
+
+// ErrBulkIndexerClosed is returned by Add after Close
+var ErrBulkIndexerClosed = errors.New("bulk indexer closed")
+
+// BulkIndexerConfig controls when buffered items are flushed to the _bulk API
+type BulkIndexerConfig struct {
+	FlushSize     int           // Flush after this many items
+	FlushBytes    int           // Flush once the request body reaches this size
+	FlushInterval time.Duration // Flush buffered items at least this often
+	QueueSize     int           // Items waiting for a flush before Add blocks
+}
+
+// DefaultBulkIndexerConfig returns a config flushing every 500 items, 5 MB or second
+func DefaultBulkIndexerConfig() BulkIndexerConfig {
+	return BulkIndexerConfig{
+		FlushSize:     500,
+		FlushBytes:    5 * 1024 * 1024,
+		FlushInterval: time.Second,
+		QueueSize:     1000,
+	}
+}
+
+// BulkItem is one action of a bulk request
+type BulkItem struct {
+	Action          string
+	Index           string
+	DocumentID      string
+	Body            []byte // Document source, or the update body for BulkActionUpdate; empty for deletes
+	Version         *int64 // Optional document version
+	VersionType     string // e.g. "external"; used with Version
+	RetryOnConflict int    // Retries of an update when the document changed concurrently
+}
+
+// BulkItemError is the per-item error reported by Elasticsearch
+type BulkItemError struct {
+	Status int
+	Type   string
+	Reason string
+}
+
+func (e *BulkItemError) Error() string {
+	return fmt.Sprintf("bulk item failed with status %d: %s: %s", e.Status, e.Type, e.Reason)
+}
+
+type pendingBulkItem struct {
+	item   BulkItem
+	result chan error
+}
+
+// BulkIndexer batches index, update and delete actions into _bulk requests.
+// Add blocks until the item's own result is known, so callers can ack or nack the
+// originating message, and blocks earlier when the queue is full to apply backpressure.
+type BulkIndexer struct {
+	esClient *elasticsearch.Client
+	config   BulkIndexerConfig
+	items    chan pendingBulkItem
+	done     chan struct{}
+	closing  chan struct{}
+	closed   bool
+	mutex    sync.RWMutex // Held by Add while queueing, so no item is queued after Close
+}
+
+// NewBulkIndexer creates a bulk indexer and starts its flush loop
+func NewBulkIndexer(esClient *elasticsearch.Client, config BulkIndexerConfig) *BulkIndexer {
+	defaults := DefaultBulkIndexerConfig()
+	if config.FlushSize <= 0 {
+		config.FlushSize = defaults.FlushSize
+	}
+	if config.FlushBytes <= 0 {
+		config.FlushBytes = defaults.FlushBytes
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaults.FlushInterval
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaults.QueueSize
+	}
+
+	indexer := &BulkIndexer{
+		esClient: esClient,
+		config:   config,
+		items:    make(chan pendingBulkItem, config.QueueSize),
+		done:     make(chan struct{}),
+		closing:  make(chan struct{}),
+	}
+	go indexer.run()
+	return indexer
+}
+
+// Add queues an item and waits until the bulk request containing it has completed
+func (b *BulkIndexer) Add(ctx context.Context, item BulkItem) error {
+	pending := pendingBulkItem{
+		item:   item,
+		result: make(chan error, 1),
+	}
+
+	if err := b.enqueue(ctx, pending); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-pending.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enqueue queues an item unless the indexer is closed. The flush loop keeps draining the queue
+// until Close holds the lock, so a blocked send completes before Close proceeds.
+func (b *BulkIndexer) enqueue(ctx context.Context, pending pendingBulkItem) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.closed {
+		return ErrBulkIndexerClosed
+	}
+
+	select {
+	case b.items <- pending:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close flushes buffered items and stops the flush loop; Add returns ErrBulkIndexerClosed afterwards
+func (b *BulkIndexer) Close(ctx context.Context) error {
+	b.mutex.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.closing)
+	}
+	b.mutex.Unlock()
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out flushing bulk indexer: %w", ctx.Err())
+	}
+}
+
+func (b *BulkIndexer) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.config.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []pendingBulkItem
+	var body bytes.Buffer
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		b.flush(batch, body.Bytes())
+		batch = nil
+		body.Reset()
+	}
+
+	add := func(pending pendingBulkItem) {
+		if err := writeBulkItem(&body, pending.item); err != nil {
+			pending.result <- err
+			return
+		}
+		batch = append(batch, pending)
+		if len(batch) >= b.config.FlushSize || body.Len() >= b.config.FlushBytes {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case pending := <-b.items:
+			add(pending)
+		case <-ticker.C:
+			flush()
+		case <-b.closing:
+			// Drain items queued before Close
+			for {
+				select {
+				case pending := <-b.items:
+					add(pending)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeBulkItem appends the action line and source line of an item to the request body
+func writeBulkItem(body *bytes.Buffer, item BulkItem) error {
+	meta := map[string]interface{}{
+		"_index": item.Index,
+	}
+	if item.DocumentID != "" {
+		meta["_id"] = item.DocumentID
+	}
+	if item.Version != nil {
+		meta["version"] = *item.Version
+		if item.VersionType != "" {
+			meta["version_type"] = item.VersionType
+		}
+	}
+
+	if item.RetryOnConflict > 0 {
+		meta["retry_on_conflict"] = item.RetryOnConflict
+	}
+
+	action, err := json.Marshal(map[string]interface{}{item.Action: meta})
+	if err != nil {
+		return fmt.Errorf("failed to marshal bulk action: %w", err)
+	}
+	body.Write(action)
+	body.WriteByte('\n')
+
+	if item.Action != BulkActionDelete {
+		body.Write(bytes.TrimSpace(item.Body))
+		body.WriteByte('\n')
+	}
+	return nil
+}
+
+// flush sends a bulk request and reports each item's result to its caller
+func (b *BulkIndexer) flush(batch []pendingBulkItem, body []byte) {
+	fail := func(err error) {
+		for _, pending := range batch {
+			pending.result <- err
+		}
+	}
+
+	res, err := b.esClient.Bulk(
+		bytes.NewReader(body),
+		b.esClient.Bulk.WithContext(context.Background()),
+	)
+	if err != nil {
+		fail(fmt.Errorf("failed to execute bulk request: %w", err))
+		return
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		errBody, _ := io.ReadAll(res.Body)
+		fail(fmt.Errorf("bulk request failed: %s: %s", res.Status(), errBody))
+		return
+	}
+
+	var response struct {
+		Errors bool                          `json:"errors"`
+		Items  []map[string]bulkResponseItem `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		fail(fmt.Errorf("failed to decode bulk response: %w", err))
+		return
+	}
+	if len(response.Items) != len(batch) {
+		fail(fmt.Errorf("bulk response has %d items, expected %d", len(response.Items), len(batch)))
+		return
+	}
+
+	failed := 0
+	for i, pending := range batch {
+		if err := bulkItemResult(pending.item, response.Items[i]); err != nil {
+			failed++
+			pending.result <- err
+			continue
+		}
+		pending.result <- nil
+	}
+
+	log.Printf("Bulk request flushed %d items (%d failed)", len(batch), failed)
+}
+
+// bulkResponseItem is the result of one action in a bulk response
+type bulkResponseItem struct {
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// bulkItemResult converts a bulk response item into the error returned to the caller
+func bulkItemResult(item BulkItem, results map[string]bulkResponseItem) error {
+	result, exists := results[item.Action]
+	if !exists {
+		return fmt.Errorf("bulk response is missing the %s result for document %s", item.Action, item.DocumentID)
+	}
+
+	switch {
+	case result.Status < 300:
+		return nil
+	case item.Action == BulkActionDelete && result.Status == http.StatusNotFound:
+		return nil // Already deleted
+	}
+
+	itemErr := &BulkItemError{Status: result.Status}
+	if result.Error != nil {
+		itemErr.Type = result.Error.Type
+		itemErr.Reason = result.Error.Reason
+	}
+	return itemErr
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"log"
+
+	"github.com/NHadi/AmanahPro-common/helpers"
+)
+
+// reindexEventType is the event used to backfill a new index version
+const reindexEventType = "Reindexed"
+
+// beginReindex routes "Reindexed" events for alias to target and dual-writes other events to both.
+// The routing is local to this consumer; other replicas are not affected.
+func (c *ConsumerService) beginReindex(alias, target string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.reindexTargets == nil {
+		c.reindexTargets = make(map[string]string)
+	}
+	c.reindexTargets[alias] = target
+	log.Printf("Consumer for queue %s is backfilling %s behind %s", c.queueName, target, alias)
+}
+
+// endReindex stops routing events for alias to its backfill index. Known tenant aliases are
+// forgotten, so they are checked again against the index the alias now points to.
+func (c *ConsumerService) endReindex(alias string) {
+	c.mutex.Lock()
+	delete(c.reindexTargets, alias)
+	c.mutex.Unlock()
+	c.tenantAliases.Clear()
+}
+
+// reindexTarget returns the index being backfilled behind an alias, if any
+func (c *ConsumerService) reindexTarget(alias string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.reindexTargets[alias]
+}
+
+// dispatch runs the handler of an event. While the target index is being backfilled,
+// "Reindexed" events go to the new index only, and other events are applied to both
+// the current and the new index so no change is lost when the alias is swapped.
+func (c *ConsumerService) dispatch(entry registeredHandler, evt *EventContext) error {
+	handler := c.handlers.chain(entry)
+
+	target, err := c.backfillIndex(evt)
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		err := handler(evt)
+		c.forgetTenantAlias(evt, err)
+		return err
+	}
+
+	if evt.Event.Type == reindexEventType {
+		evt.Index = target
+		return handler(evt)
+	}
+
+	if err := handler(evt); err != nil {
+		c.forgetTenantAlias(evt, err)
+		return err
+	}
+	backfill := *evt
+	backfill.Index = target
+	err = entry.handler(&backfill)
+	if isDocumentMissing(err) {
+		// Not backfilled yet; the backfill copies the document with this change
+		log.Printf("Skipped update of document not yet backfilled in %s", target)
+		return nil
+	}
+	return err
+}
+
+// backfillIndex returns the index an event is also written to while its index is backfilled.
+// With filtered aliases the backfill is looked up by the base index and written through the
+// organization's alias on the new index, so documents keep their routing.
+func (c *ConsumerService) backfillIndex(evt *EventContext) (string, error) {
+	if c.tenancy.Mode != helpers.TenancyFilteredAlias || evt.OrganizationID == nil {
+		return c.reindexTarget(evt.Index), nil
+	}
+
+	target := c.reindexTarget(evt.baseIndex)
+	if target == "" {
+		return "", nil
+	}
+	return c.ensureTenantAlias(evt.Context, target, *evt.OrganizationID)
+}
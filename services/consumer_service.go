@@ -3,22 +3,54 @@ package services
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"sync"
 	"time"
 
+	"github.com/NHadi/AmanahPro-common/helpers"
+	"github.com/NHadi/AmanahPro-common/messagebroker"
 	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
 	"github.com/streadway/amqp"
 )
 
+// errEventInProgress is returned when another delivery of the same event holds the idempotency claim
+var errEventInProgress = errors.New("event is being processed by another delivery")
+
+// retryConfirmTimeout bounds how long a failed message waits for the broker to confirm its retry copy
+const retryConfirmTimeout = 10 * time.Second
+
 type ConsumerService struct {
-	esClient        *elasticsearch.Client
-	index           string
-	auditTrailIndex string
-	queueName       string
-	handlers        map[string]func(map[string]interface{}, map[string]interface{}) error // Event-specific handlers
+	esClient           *elasticsearch.Client
+	index              string
+	auditTrailIndex    string
+	queueName          string
+	handlers           *handlerRegistry        // Event-specific handlers
+	scripts            map[string]updateScript // Scripts "ScriptUpdated" events may run, by name
+	retryPolicy        messagebroker.RetryPolicy
+	prefetch           int
+	idempotency        IdempotencyStore
+	idempotencyTTL     time.Duration
+	processingTTL      time.Duration
+	bulkIndexer        *BulkIndexer
+	externalVersioning bool
+	versionField       string
+	ordered            bool
+	tenancy            helpers.Tenancy
+	tenantAliases      sync.Map          // Filtered aliases known to exist
+	reindexTargets     map[string]string // Alias to the index being backfilled behind it
+	auditChain         *AuditChain
+	subscription       *messagebroker.Subscription
+	consumer           *messagebroker.ManagedConsumer
+	retryPublishers    sync.Map // Consumer channel to the *messagebroker.ConfirmPublisher for its retries
+	mutex              sync.Mutex
 }
 
 // NewConsumerService initializes a consumer with handlers
@@ -28,61 +60,296 @@ func NewConsumerService(esClient *elasticsearch.Client, index, auditTrailIndex,
 		index:           index,
 		auditTrailIndex: auditTrailIndex,
 		queueName:       queueName,
-		handlers:        make(map[string]func(map[string]interface{}, map[string]interface{}) error),
+		handlers:        newHandlerRegistry(),
+		scripts:         make(map[string]updateScript),
+		retryPolicy:     messagebroker.DefaultRetryPolicy(),
 	}
 
 	// Register standard event handlers
-	service.handlers["Created"] = service.handleCreatedOrUpdated
-	service.handlers["Updated"] = service.handleCreatedOrUpdated
-	service.handlers["Deleted"] = service.handleDeleted
+	service.RegisterHandler("Created", service.handleCreatedOrUpdated)
+	service.RegisterHandler("Updated", service.handleCreatedOrUpdated)
+	service.RegisterHandler("Deleted", service.handleDeleted)
+	service.RegisterHandler("Patched", service.handlePatched)
+	service.RegisterHandler("Upserted", service.handleUpserted)
+	service.RegisterHandler("ScriptUpdated", service.handleScriptUpdated)
+	service.RegisterHandler("ItemAdded", service.AddItemHandler("", ""))
+	service.RegisterHandler("ItemRemoved", service.RemoveItemHandler("", ""))
 
 	// Register custom event handlers
-	service.handlers["Reindexed"] = service.handleCreatedOrUpdated
+	service.RegisterHandler(reindexEventType, service.handleCreatedOrUpdated)
 
 	return service
 }
 
-func (c *ConsumerService) StartConsumer(channel *amqp.Channel, concurrency int) error {
-	msgs, err := channel.Consume(
-		c.queueName,
-		"",    // Consumer tag
-		false, // Manual acknowledgment
-		false, // Exclusive
-		false, // No-local
-		false, // No-wait
-		nil,   // Arguments
-	)
+// SetRetryPolicy configures how failed messages are retried and dead-lettered.
+// A policy with MaxAttempts 0 requeues failed messages immediately.
+func (c *ConsumerService) SetRetryPolicy(policy messagebroker.RetryPolicy) {
+	c.retryPolicy = policy
+}
+
+// SetIdempotencyStore enables deduplication of redelivered events. Events are keyed on the
+// envelope ID, falling back to the AMQP message ID and finally to a hash of the body;
+// successful outcomes are remembered for ttl.
+func (c *ConsumerService) SetIdempotencyStore(store IdempotencyStore, ttl time.Duration) {
+	c.idempotency = store
+	c.idempotencyTTL = ttl
+	if c.processingTTL == 0 {
+		c.processingTTL = 5 * time.Minute
+	}
+}
+
+// SetProcessingTTL sets how long an event stays claimed while it is being processed,
+// after which a crashed worker's claim expires and the event can be processed again.
+// Redeliveries of a claimed event are deferred to the first retry queue until then.
+// The TTL must be at least a millisecond, the precision of the Redis claim.
+func (c *ConsumerService) SetProcessingTTL(ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return fmt.Errorf("processing TTL must be at least 1ms, got %s", ttl)
+	}
+	c.processingTTL = ttl
+	return nil
+}
+
+// EnableBulkIndexing routes index and delete operations through a BulkIndexer.
+// Each worker waits for its own item result, so batches fill up across workers:
+// use a concurrency (and prefetch) at least as large as FlushSize for full batches.
+func (c *ConsumerService) EnableBulkIndexing(config BulkIndexerConfig) {
+	c.bulkIndexer = NewBulkIndexer(c.esClient, config)
+}
+
+// SetPrefetch sets how many unacknowledged messages RabbitMQ may push to this consumer.
+// By default it matches the concurrency, so the broker does not hand the whole backlog to one pod.
+func (c *ConsumerService) SetPrefetch(count int) {
+	c.prefetch = count
+}
+
+// prefetchCount returns the effective prefetch for the given worker pool size
+func (c *ConsumerService) prefetchCount(concurrency int) int {
+	if c.prefetch > 0 {
+		return c.prefetch
+	}
+	if concurrency > 0 {
+		return concurrency
+	}
+	return 1
+}
+
+// StartConsumer consumes the queue through the RabbitMQ service, so the consumer is re-subscribed
+// after every reconnect, and blocks until the consumer is stopped.
+func (c *ConsumerService) StartConsumer(service *messagebroker.RabbitMQService, concurrency int) error {
+	if err := c.Subscribe(context.Background(), service, concurrency); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	consumer := c.consumer
+	c.mutex.Unlock()
+
+	<-consumer.Done()
+	return nil
+}
+
+// Start begins consuming the queue with up to concurrency workers and returns immediately.
+// The channel should be dedicated to this consumer since its prefetch is changed. The consumer
+// stops when the channel is closed and is not re-subscribed after a reconnect; use Subscribe for that.
+// Cancelling ctx stops the consumer; call Stop to also wait for in-flight messages.
+func (c *ConsumerService) Start(ctx context.Context, channel *amqp.Channel, concurrency int) error {
+	if err := channel.Qos(c.prefetchCount(concurrency), 0, false); err != nil {
+		return fmt.Errorf("failed to set prefetch: %w", err)
+	}
+
+	if err := c.setupRetries(channel); err != nil {
+		return err
+	}
+
+	subscription, err := messagebroker.SubscribeOrdered(ctx, channel, c.queueName, concurrency, false, c.partitionKeyFunc(), func(m amqp.Delivery) {
+		c.handleDelivery(channel, m)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start consuming messages: %w", err)
+	}
+
+	c.mutex.Lock()
+	c.subscription = subscription
+	c.mutex.Unlock()
+
+	log.Printf("Consumer is now actively listening to queue: %s", c.queueName)
+	return nil
+}
+
+// Subscribe registers the consumer with the RabbitMQ service and returns immediately.
+// The consumer gets its own channel, separate from publishers, and unlike Start it is
+// re-subscribed with the same queue, concurrency and prefetch after every reconnect.
+// Cancelling ctx stops the consumer.
+func (c *ConsumerService) Subscribe(ctx context.Context, service *messagebroker.RabbitMQService, concurrency int) error {
+	consumer, err := service.RegisterConsumer(ctx, messagebroker.ConsumerConfig{
+		QueueName:    c.queueName,
+		Concurrency:  concurrency,
+		Prefetch:     c.prefetchCount(concurrency),
+		Setup:        c.setupRetries,
+		Handler:      c.handleDelivery,
+		PartitionKey: c.partitionKeyFunc(),
+	})
 	if err != nil {
 		return fmt.Errorf("failed to start consuming messages: %w", err)
 	}
 
-	workerChan := make(chan bool, concurrency)
+	c.mutex.Lock()
+	c.consumer = consumer
+	c.mutex.Unlock()
 
+	log.Printf("Consumer is now actively listening to queue: %s", c.queueName)
+	return nil
+}
+
+// Stop cancels the consumer and waits for in-flight messages to be acked or nacked until ctx expires
+func (c *ConsumerService) Stop(ctx context.Context) error {
+	c.mutex.Lock()
+	subscription, consumer := c.subscription, c.consumer
+	c.mutex.Unlock()
+
+	var err error
+	switch {
+	case consumer != nil:
+		err = consumer.Stop(ctx)
+	case subscription != nil:
+		err = subscription.Stop(ctx)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Consumer stopped listening to queue: %s", c.queueName)
+	return nil
+}
+
+// Close stops the consumer and flushes the bulk indexer, if enabled
+func (c *ConsumerService) Close(ctx context.Context) error {
+	if err := c.Stop(ctx); err != nil {
+		return err
+	}
+	if c.bulkIndexer != nil {
+		return c.bulkIndexer.Close(ctx)
+	}
+	return nil
+}
+
+// partitionKeyFunc returns the key function used for ordered processing, or nil
+func (c *ConsumerService) partitionKeyFunc() func(amqp.Delivery) string {
+	if !c.ordered {
+		return nil
+	}
+	return c.partitionKey
+}
+
+// handleDelivery processes a delivery and acks it, or hands it to the retry policy on failure
+func (c *ConsumerService) handleDelivery(channel *amqp.Channel, m amqp.Delivery) {
+	err := c.processMessage(m.Body, m.MessageId)
+	if errors.Is(err, errEventInProgress) {
+		log.Printf("Deferring message: %v", err)
+		c.deferDelivery(channel, m)
+		return
+	}
+	if err != nil {
+		log.Printf("Error processing message: %v", err)
+		c.handleFailure(channel, m, err)
+	} else {
+		m.Ack(false) // Acknowledge successful processing
+	}
+}
+
+// setupRetries declares the retry and dead-letter queues used by the retry policy and puts the
+// consumer channel into confirm mode, so failed messages are acked only once their retry is stored
+func (c *ConsumerService) setupRetries(channel *amqp.Channel) error {
+	if !c.retryPolicy.Enabled() {
+		return nil
+	}
+	if err := c.retryPolicy.Declare(channel, c.queueName); err != nil {
+		return fmt.Errorf("failed to declare retry queues: %w", err)
+	}
+
+	publisher, err := messagebroker.NewConfirmPublisher(channel, retryConfirmTimeout)
+	if err != nil {
+		return err
+	}
+	c.retryPublishers.Store(channel, publisher)
+
+	closed := channel.NotifyClose(make(chan *amqp.Error, 1))
 	go func() {
-		for msg := range msgs {
-			workerChan <- true
-			go func(m amqp.Delivery) {
-				defer func() { <-workerChan }()
-				if err := c.processMessage(m.Body); err != nil {
-					log.Printf("Error processing message: %v", err)
-					m.Nack(false, true) // Requeue message on failure
-				} else {
-					m.Ack(false) // Acknowledge successful processing
-				}
-			}(msg)
-		}
+		<-closed
+		c.retryPublishers.Delete(channel)
 	}()
+	return nil
+}
 
-	log.Printf("Consumer is now actively listening to queue: %s", c.queueName)
-	select {} // Keep the consumer running
+// deferDelivery moves a message whose event is still in progress to the first retry queue without
+// counting an attempt, so it comes back after the first backoff without blocking the worker.
+// Without a retry queue it is requeued immediately.
+func (c *ConsumerService) deferDelivery(channel *amqp.Channel, m amqp.Delivery) {
+	publisher, exists := c.retryPublishers.Load(channel)
+	if !exists || c.retryPolicy.MaxAttempts < 2 {
+		m.Nack(false, true)
+		return
+	}
+
+	if err := messagebroker.Defer(publisher.(*messagebroker.ConfirmPublisher), m, c.queueName, c.retryPolicy); err != nil {
+		log.Printf("Failed to defer message: %v", err)
+		m.Nack(false, true)
+		return
+	}
+	m.Ack(false)
 }
 
-func (c *ConsumerService) saveEventToElasticsearch(event struct {
-	Event     string                 `json:"event"`
-	Payload   map[string]interface{} `json:"payload"`
-	Meta      map[string]interface{} `json:"meta"`
-	Timestamp string                 `json:"timestamp"` // Add timestamp field
-}) error {
+// handleFailure moves a failed message to its retry or dead-letter queue, or requeues it
+// when retries are disabled or the retry queue cannot be reached.
+func (c *ConsumerService) handleFailure(channel *amqp.Channel, m amqp.Delivery, processErr error) {
+	if !c.retryPolicy.Enabled() {
+		m.Nack(false, true) // Requeue message on failure
+		return
+	}
+
+	publisher, exists := c.retryPublishers.Load(channel)
+	if !exists {
+		log.Printf("No retry publisher for the consumer channel, requeueing message")
+		m.Nack(false, true)
+		return
+	}
+
+	if err := messagebroker.RetryOrDeadLetter(publisher.(*messagebroker.ConfirmPublisher), m, c.queueName, c.retryPolicy, processErr); err != nil {
+		log.Printf("Failed to schedule retry: %v", err)
+		m.Nack(false, true)
+		return
+	}
+
+	if attempts := messagebroker.RetryAttempts(m) + 1; attempts >= c.retryPolicy.MaxAttempts {
+		log.Printf("Message moved to dead-letter queue %s after %d attempts", messagebroker.DeadLetterQueueName(c.queueName), attempts)
+	}
+	m.Ack(false)
+}
+
+// SetAuditChain appends saved events to a hash chain per organization and resource instead of
+// overwriting them by event key. Events are appended after their handler succeeds; use an
+// idempotency store so redelivered events that already completed are not chained twice.
+// The chain fields are mapped on the chain's index first; an index that maps them differently,
+// such as an existing dynamically mapped audit index, is rejected.
+func (c *ConsumerService) SetAuditChain(ctx context.Context, chain *AuditChain) error {
+	if err := chain.EnsureMappings(ctx); err != nil {
+		return err
+	}
+	c.auditChain = chain
+	return nil
+}
+
+func (c *ConsumerService) saveEventToElasticsearch(event *messagebroker.Event, eventKey string) error {
+	if c.auditChain != nil {
+		link, err := c.auditChain.Append(context.Background(), ChainID(event.OrganizationID, event.Resource), event)
+		if err != nil {
+			return fmt.Errorf("failed to append event to audit chain: %w", err)
+		}
+		log.Printf("Event saved to audit chain %s with sequence %d", link.ChainID, link.Sequence)
+		return nil
+	}
 
 	// Marshal the event into JSON
 	data, err := json.Marshal(event)
@@ -90,8 +357,8 @@ func (c *ConsumerService) saveEventToElasticsearch(event struct {
 		return fmt.Errorf("failed to marshal event: %w", err)
 	}
 
-	// Generate a unique document ID (optional)
-	docID := fmt.Sprintf("%s-%d", event.Event, time.Now().UnixNano())
+	// Use the event key as document ID so a redelivered event overwrites its audit entry
+	docID := fmt.Sprintf("%s-%s", event.Type, eventKey)
 
 	// Index the document in Elasticsearch
 	res, err := c.esClient.Index(
@@ -104,128 +371,248 @@ func (c *ConsumerService) saveEventToElasticsearch(event struct {
 		return fmt.Errorf("failed to index event in Elasticsearch: %w", err)
 	}
 	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("failed to index event in Elasticsearch: %w", helpers.NewElasticsearchError(res))
+	}
 
 	log.Printf("Event saved to Elasticsearch index %s with ID: %s", c.auditTrailIndex, docID)
 	return nil
 }
 
-// processMessage routes messages to appropriate handlers
-func (c *ConsumerService) processMessage(msg []byte) error {
+// eventKey identifies an event for deduplication
+func eventKey(event *messagebroker.Event, messageID string, body []byte) string {
+	if event.ID != "" {
+		return event.ID
+	}
+	if messageID != "" {
+		return messageID
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// processMessage parses a message and processes it at most once per event key when an idempotency store is set
+func (c *ConsumerService) processMessage(msg []byte, messageID string) error {
 	log.Printf("Processing message from queue %s: %s", c.queueName, string(msg))
 
-	var event struct {
-		Event     string                 `json:"event"`
-		Payload   map[string]interface{} `json:"payload"`
-		Meta      map[string]interface{} `json:"meta"`      // Optional metadata
-		Timestamp string                 `json:"timestamp"` // Add timestamp field
+	// Parse the message envelope
+	event, err := messagebroker.ParseEvent(msg)
+	if err != nil {
+		return fmt.Errorf("failed to parse message: %w", err)
 	}
+	key := eventKey(event, messageID, msg)
 
-	event.Timestamp = time.Now().Format(time.RFC3339)
+	if c.idempotency == nil {
+		return c.processEvent(event, key)
+	}
 
-	// Parse the message
-	if err := json.Unmarshal(msg, &event); err != nil {
-		return fmt.Errorf("failed to parse message: %w", err)
+	ctx := context.Background()
+	idempotencyKey := c.queueName + ":" + key
+	claimed, err := c.idempotency.Begin(ctx, idempotencyKey, c.processingTTL)
+	if err != nil {
+		return fmt.Errorf("failed to check idempotency: %w", err)
+	}
+	if !claimed {
+		record, err := c.idempotency.Get(ctx, idempotencyKey)
+		if err != nil {
+			return fmt.Errorf("failed to check idempotency: %w", err)
+		}
+		if record != nil && record.Status == IdempotencyCompleted {
+			log.Printf("Skipping already processed event %s (%s)", key, event.Type)
+			return nil
+		}
+		// Still claimed, possibly by a worker that crashed; retry until the claim completes or expires
+		return fmt.Errorf("%w: %s", errEventInProgress, key)
+	}
+
+	if err := c.processEvent(event, key); err != nil {
+		if failErr := c.idempotency.Fail(ctx, idempotencyKey, err, c.idempotencyTTL); failErr != nil {
+			log.Printf("Failed to record idempotency failure for event %s: %v", key, failErr)
+		}
+		return err
+	}
+
+	if err := c.idempotency.Complete(ctx, idempotencyKey, c.idempotencyTTL); err != nil {
+		log.Printf("Failed to record idempotency outcome for event %s: %v", key, err)
 	}
+	return nil
+}
 
-	// Save the full event into Elasticsearch
-	err := c.saveEventToElasticsearch(event)
+// processEvent routes an event to the appropriate handler
+func (c *ConsumerService) processEvent(event *messagebroker.Event, key string) error {
+	payload, err := decodePayload(event.Payload)
 	if err != nil {
-		log.Printf("Error saving event to Elasticsearch: %v", err)
-		// Optionally handle this error if saving is critical
+		return fmt.Errorf("failed to parse payload of event %s: %w", event.Type, err)
 	}
 
 	// Route to the appropriate handler
-	handler, exists := c.handlers[event.Event]
+	entry, exists := c.handlers.resolve(event.Type)
 	if !exists {
-		log.Printf("Unhandled event type: %s", event.Event)
-		return nil // Acknowledge unknown event types to prevent re-delivery
+		log.Printf("Unhandled event type: %s", event.Type)
+		// Save the full event, then acknowledge unknown event types to prevent re-delivery
+		return c.saveEventToElasticsearch(event, key)
+	}
+
+	index := c.index
+	if entry.options.Index != "" {
+		index = entry.options.Index
+	}
+
+	evt := &EventContext{
+		Context:   context.Background(),
+		Event:     event,
+		Payload:   payload,
+		Meta:      event.Meta,
+		Index:     index,
+		baseIndex: index,
+		key:       key,
+		options:   entry.options,
+	}
+	if err := c.applyTenancy(evt); err != nil {
+		return err
+	}
+	if err := c.dispatch(entry, evt); err != nil {
+		return err
 	}
 
-	// Pass both payload and meta to the handler
-	return handler(event.Payload, event.Meta)
+	// Save the full event once it is handled, so a retried event is saved once; a failed save
+	// retries the event, which handlers apply idempotently
+	return c.saveEventToElasticsearch(event, key)
 }
 
 // handleCreatedOrUpdated handles "Created" or "Updated" events
-func (c *ConsumerService) handleCreatedOrUpdated(payload map[string]interface{}, meta map[string]interface{}) error {
-	idField := "id" // Default primary key field
-
-	// Check for custom primary key field in metadata (optional)
-	if field, exists := meta["idField"].(string); exists {
-		idField = field
+func (c *ConsumerService) handleCreatedOrUpdated(evt *EventContext) error {
+	docID, err := evt.DocumentID()
+	if err != nil {
+		return err
 	}
 
-	// Retrieve document ID
-	docID, ok := payload[idField].(float64) // JSON numbers are float64
-	if !ok {
-		return fmt.Errorf("missing or invalid document ID (field: %s) in payload", idField)
+	version, err := c.documentVersion(evt.Payload, evt.Meta)
+	if err != nil {
+		return err
 	}
 
-	// Convert float64 ID to string for Elasticsearch
-	docIDStr := fmt.Sprintf("%.0f", docID)
-
-	log.Printf("Indexing document with ID %s", docIDStr)
-	return c.indexDocument(docIDStr, payload)
+	log.Printf("Indexing document with ID %s", docID)
+	return c.indexDocument(evt.Context, evt.Index, docID, evt.Payload, version)
 }
 
 // handleDeleted handles "Deleted" events
-func (c *ConsumerService) handleDeleted(payload map[string]interface{}, meta map[string]interface{}) error {
-	idField := "id"
-
-	if field, exists := meta["idField"].(string); exists {
-		idField = field
+func (c *ConsumerService) handleDeleted(evt *EventContext) error {
+	docID, err := evt.DocumentID()
+	if err != nil {
+		return err
 	}
 
-	docID, ok := payload[idField].(float64)
-	if !ok {
-		return fmt.Errorf("missing or invalid document ID (field: %s) in payload", idField)
+	version, err := c.documentVersion(evt.Payload, evt.Meta)
+	if err != nil {
+		return err
 	}
 
-	docIDStr := fmt.Sprintf("%.0f", docID)
-
-	log.Printf("Deleting document with ID %s", docIDStr)
-	return c.deleteDocument(docIDStr)
+	log.Printf("Deleting document with ID %s", docID)
+	return c.deleteDocument(evt.Context, evt.Index, docID, version)
 }
 
 // indexDocument indexes or updates a document in Elasticsearch
-func (c *ConsumerService) indexDocument(docID string, document map[string]interface{}) error {
+func (c *ConsumerService) indexDocument(ctx context.Context, index, docID string, document map[string]interface{}, version *int64) error {
 	data, err := json.Marshal(document)
 	if err != nil {
 		return fmt.Errorf("failed to marshal document: %w", err)
 	}
 
-	res, err := c.esClient.Index(
-		c.index,
-		bytes.NewReader(data),
+	if c.bulkIndexer != nil {
+		err := c.bulkIndexer.Add(ctx, c.bulkItem(BulkActionIndex, index, docID, data, version))
+		if isVersionConflict(err) {
+			log.Printf("Skipped stale version of document %s in %s", docID, index)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to index document %s: %w", docID, err)
+		}
+		return nil
+	}
+
+	options := []func(*esapi.IndexRequest){
 		c.esClient.Index.WithDocumentID(docID),
-		c.esClient.Index.WithContext(context.Background()),
-	)
+		c.esClient.Index.WithContext(ctx),
+	}
+	if version != nil {
+		options = append(options,
+			c.esClient.Index.WithVersion(int(*version)),
+			c.esClient.Index.WithVersionType(versionTypeExternal),
+		)
+	}
+
+	res, err := c.esClient.Index(index, bytes.NewReader(data), options...)
 	if err != nil {
 		return fmt.Errorf("failed to index document: %w", err)
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusConflict {
+		log.Printf("Skipped stale version of document %s in %s", docID, index)
+		return nil
+	}
+
 	if res.IsError() {
 		body, _ := io.ReadAll(res.Body)
 		log.Printf("Elasticsearch indexing error: %s", body)
 		return nil
 	}
 
-	log.Printf("Document indexed in %s: %s", c.index, docID)
+	log.Printf("Document indexed in %s: %s", index, docID)
 	return nil
 }
 
 // deleteDocument removes a document from Elasticsearch
-func (c *ConsumerService) deleteDocument(docID string) error {
-	res, err := c.esClient.Delete(
-		c.index,
-		docID,
-		c.esClient.Delete.WithContext(context.Background()),
-	)
+func (c *ConsumerService) deleteDocument(ctx context.Context, index, docID string, version *int64) error {
+	if c.bulkIndexer != nil {
+		err := c.bulkIndexer.Add(ctx, c.bulkItem(BulkActionDelete, index, docID, nil, version))
+		if isVersionConflict(err) {
+			log.Printf("Skipped stale delete of document %s in %s", docID, index)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete document %s: %w", docID, err)
+		}
+		return nil
+	}
+
+	options := []func(*esapi.DeleteRequest){
+		c.esClient.Delete.WithContext(ctx),
+	}
+	if version != nil {
+		options = append(options,
+			c.esClient.Delete.WithVersion(int(*version)),
+			c.esClient.Delete.WithVersionType(versionTypeExternal),
+		)
+	}
+
+	res, err := c.esClient.Delete(index, docID, options...)
 	if err != nil {
 		return fmt.Errorf("failed to delete document: %w", err)
 	}
 	defer res.Body.Close()
 
-	log.Printf("Document deleted from %s: %s", c.index, docID)
+	if res.StatusCode == http.StatusConflict {
+		log.Printf("Skipped stale delete of document %s in %s", docID, index)
+		return nil
+	}
+
+	log.Printf("Document deleted from %s: %s", index, docID)
 	return nil
 }
+
+// bulkItem builds a bulk action for the given index
+func (c *ConsumerService) bulkItem(action, index, docID string, body []byte, version *int64) BulkItem {
+	item := BulkItem{
+		Action:     action,
+		Index:      index,
+		DocumentID: docID,
+		Body:       body,
+	}
+	if version != nil {
+		item.Version = version
+		item.VersionType = versionTypeExternal
+	}
+	return item
+}
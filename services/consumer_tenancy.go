@@ -0,0 +1,106 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/NHadi/AmanahPro-common/helpers"
+)
+
+// indexNotFoundException is the error type of a write to a missing index or alias
+const indexNotFoundException = "index_not_found_exception"
+
+// EnableTenancy routes documents to the index or filtered alias of their organization.
+// The organization is taken from the event envelope, falling back to the tenancy field
+// in the payload; events without an organization fail. The organization ID is written
+// into each document so filtered aliases and ScopeQuery match it.
+func (c *ConsumerService) EnableTenancy(tenancy helpers.Tenancy) {
+	c.tenancy = tenancy
+}
+
+// applyTenancy resolves the organization of an event and points it at the tenant index
+func (c *ConsumerService) applyTenancy(evt *EventContext) error {
+	if !c.tenancy.Enabled() {
+		return nil
+	}
+
+	field := c.tenancy.OrganizationField()
+	organizationID, err := eventOrganization(evt, field)
+	if err != nil {
+		return err
+	}
+
+	if c.tenancy.Mode == helpers.TenancyFilteredAlias {
+		if _, err := c.ensureTenantAlias(evt.Context, evt.Index, organizationID); err != nil {
+			return err
+		}
+	}
+
+	if evt.Payload == nil {
+		evt.Payload = make(map[string]interface{})
+	}
+	if _, exists := evt.Payload[field]; !exists {
+		evt.Payload[field] = organizationID
+	}
+
+	evt.OrganizationID = &organizationID
+	evt.Index = c.tenancy.IndexName(evt.Index, organizationID)
+	return nil
+}
+
+// ensureTenantAlias creates the filtered alias of an organization on base once and returns its name
+func (c *ConsumerService) ensureTenantAlias(ctx context.Context, base string, organizationID int) (string, error) {
+	alias := c.tenancy.IndexName(base, organizationID)
+	if _, exists := c.tenantAliases.Load(alias); exists {
+		return alias, nil
+	}
+	if err := c.tenancy.EnsureAlias(ctx, c.esClient, base, organizationID); err != nil {
+		return "", err
+	}
+	c.tenantAliases.Store(alias, struct{}{})
+	return alias, nil
+}
+
+// forgetTenantAlias drops the cached alias of an event whose write found no index,
+// e.g. after the alias was removed, so the next delivery creates it again
+func (c *ConsumerService) forgetTenantAlias(evt *EventContext, err error) {
+	if c.tenancy.Mode != helpers.TenancyFilteredAlias || !isIndexNotFound(err) {
+		return
+	}
+	c.tenantAliases.Delete(evt.Index)
+	log.Printf("Alias %s not found; it is created again on the next event", evt.Index)
+}
+
+// isIndexNotFound reports whether a write failed because its index or alias does not exist
+func isIndexNotFound(err error) bool {
+	var itemErr *BulkItemError
+	if errors.As(err, &itemErr) {
+		return itemErr.Type == indexNotFoundException
+	}
+	var esErr *helpers.ElasticsearchError
+	return errors.As(err, &esErr) && esErr.Type == indexNotFoundException
+}
+
+// eventOrganization returns the organization of an event from the envelope or payload
+func eventOrganization(evt *EventContext, field string) (int, error) {
+	if evt.Event.OrganizationID != nil {
+		return *evt.Event.OrganizationID, nil
+	}
+
+	value, exists := lookupField(evt.Payload, field)
+	if !exists {
+		return 0, fmt.Errorf("event %s has no organization (envelope or payload field %s)", evt.Event.Type, field)
+	}
+	id, err := formatID(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid organization in payload field %s: %w", field, err)
+	}
+	organizationID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, fmt.Errorf("invalid organization in payload field %s: %w", field, err)
+	}
+	return organizationID, nil
+}
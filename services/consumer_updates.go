@@ -0,0 +1,340 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/NHadi/AmanahPro-common/helpers"
+)
+
+// retryOnConflict is how often Elasticsearch retries an update that raced with another write
+const retryOnConflict = 3
+
+// documentMissingException is the error type of an update to a missing document
+const documentMissingException = "document_missing_exception"
+
+// lastEventField holds the key of the last event a registered inline script applied to a document
+const lastEventField = "lastEventId"
+
+// guardedScript wraps the source of a registered script so it runs once per event: it records the
+// event key in the document and does nothing when the document already holds it
+const guardedScript = `
+if (ctx._source[params.lastEventField] != null && ctx._source[params.lastEventField] == params.lastEventId) {
+  ctx.op = 'noop';
+} else {
+  ctx._source[params.lastEventField] = params.lastEventId;
+  %s
+}
+`
+
+// addItemScript replaces the item with the same ID in the array, or appends it,
+// so a redelivered event does not add the item twice
+const addItemScript = `
+if (ctx._source[params.field] == null) { ctx._source[params.field] = []; }
+if (params.itemId != null) {
+  ctx._source[params.field].removeIf(item -> item[params.idField] != null && String.valueOf(item[params.idField]) == params.itemId);
+}
+ctx._source[params.field].add(params.item);
+`
+
+// removeItemScript removes the items with the given ID from the array
+const removeItemScript = `
+if (ctx._source[params.field] == null || !ctx._source[params.field].removeIf(item -> item[params.idField] != null && String.valueOf(item[params.idField]) == params.itemId)) {
+  ctx.op = 'noop';
+}
+`
+
+// PatchHandler returns the built-in handler that merges the payload into an existing document
+func (c *ConsumerService) PatchHandler() EventHandler {
+	return c.handlePatched
+}
+
+// UpsertHandler returns the built-in handler that merges the payload into a document, creating it if missing
+func (c *ConsumerService) UpsertHandler() EventHandler {
+	return c.handleUpserted
+}
+
+// updateScript is a script that "ScriptUpdated" events may run, either inline painless source
+// or the ID of a script stored in Elasticsearch
+type updateScript struct {
+	source   string
+	storedID string
+}
+
+// RegisterScript allows "ScriptUpdated" events to run the painless source under name.
+// Events only select scripts by name, so publishers cannot run arbitrary code. Register
+// scripts before the consumer starts. The script runs once per event: the event key is stored
+// in the document field "lastEventId", and a retried event that already applied is skipped.
+func (c *ConsumerService) RegisterScript(name, source string) {
+	c.scripts[name] = updateScript{source: fmt.Sprintf(guardedScript, source)}
+}
+
+// RegisterStoredScript allows "ScriptUpdated" events to run the stored script scriptID under name.
+// Stored scripts are not guarded against retries; they receive the event key and field name in
+// params "lastEventId" and "lastEventField" to skip events they already applied.
+func (c *ConsumerService) RegisterStoredScript(name, scriptID string) {
+	c.scripts[name] = updateScript{storedID: scriptID}
+}
+
+// ScriptHandler returns the built-in handler that applies a registered script to a document
+func (c *ConsumerService) ScriptHandler() EventHandler {
+	return c.handleScriptUpdated
+}
+
+// handlePatched handles "Patched" events: the payload holds the document ID and the changed fields only.
+// Updates cannot be externally versioned; use ordered processing to apply them in order.
+func (c *ConsumerService) handlePatched(evt *EventContext) error {
+	docID, err := evt.DocumentID()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Patching document with ID %s", docID)
+	return c.updateDocument(evt.Context, evt.Index, docID, map[string]interface{}{
+		"doc": evt.Payload,
+	}, false)
+}
+
+// handleUpserted handles "Upserted" events, indexing the payload as a new document when none exists
+func (c *ConsumerService) handleUpserted(evt *EventContext) error {
+	docID, err := evt.DocumentID()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Upserting document with ID %s", docID)
+	return c.updateDocument(evt.Context, evt.Index, docID, map[string]interface{}{
+		"doc":           evt.Payload,
+		"doc_as_upsert": true,
+	}, false)
+}
+
+// handleScriptUpdated handles "ScriptUpdated" events, e.g. for counters and aggregates.
+// The payload holds the document ID, "script" (the name of a script registered with
+// RegisterScript or RegisterStoredScript, or meta "script"), optional "params" passed to
+// the script and an optional "upsert" document used when the document is missing.
+func (c *ConsumerService) handleScriptUpdated(evt *EventContext) error {
+	docID, err := evt.DocumentID()
+	if err != nil {
+		return err
+	}
+
+	name, _ := evt.Payload["script"].(string)
+	if name == "" {
+		name, _ = evt.Meta["script"].(string)
+	}
+	if name == "" {
+		return fmt.Errorf("missing script for document %s", docID)
+	}
+	registered, exists := c.scripts[name]
+	if !exists {
+		return fmt.Errorf("script %q is not registered", name)
+	}
+
+	script := map[string]interface{}{}
+	if registered.storedID != "" {
+		script["id"] = registered.storedID
+	} else {
+		script["source"] = registered.source
+		script["lang"] = "painless"
+	}
+	params := map[string]interface{}{}
+	if payloadParams, exists := evt.Payload["params"]; exists {
+		values, ok := payloadParams.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid params for script %s of document %s", name, docID)
+		}
+		for key, value := range values {
+			params[key] = value
+		}
+	}
+	params["lastEventField"] = lastEventField
+	params["lastEventId"] = evt.key
+	script["params"] = params
+
+	body := map[string]interface{}{
+		"script": script,
+	}
+	if upsert, exists := evt.Payload["upsert"]; exists {
+		// The upsert document does not run the script; record the event so a retry skips it
+		if document, ok := upsert.(map[string]interface{}); ok && registered.source != "" {
+			recorded := make(map[string]interface{}, len(document)+1)
+			for key, value := range document {
+				recorded[key] = value
+			}
+			recorded[lastEventField] = evt.key
+			upsert = recorded
+		}
+		body["upsert"] = upsert
+	}
+
+	log.Printf("Applying script %s to document with ID %s", name, docID)
+	return c.updateDocument(evt.Context, evt.Index, docID, body, false)
+}
+
+// AddItemHandler returns a handler that adds payload "item" to the array field of a document,
+// e.g. an SphDetail line to its SPH section. Items are matched on itemIDField (default "id"),
+// so adding an item again replaces it. Empty arguments are read from meta "arrayField" and "itemIdField".
+func (c *ConsumerService) AddItemHandler(arrayField, itemIDField string) EventHandler {
+	return func(evt *EventContext) error {
+		docID, err := evt.DocumentID()
+		if err != nil {
+			return err
+		}
+		field, idField, err := arrayFields(evt.Meta, arrayField, itemIDField)
+		if err != nil {
+			return err
+		}
+
+		item, ok := evt.Payload["item"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("missing or invalid item in payload for document %s", docID)
+		}
+
+		params := map[string]interface{}{
+			"field":   field,
+			"idField": idField,
+			"item":    item,
+			"itemId":  nil,
+		}
+		if itemID, exists := item[idField]; exists && itemID != nil {
+			params["itemId"] = itemIDString(itemID)
+		}
+
+		log.Printf("Adding item to %s of document with ID %s", field, docID)
+		return c.updateDocument(evt.Context, evt.Index, docID, map[string]interface{}{
+			"script": map[string]interface{}{
+				"source": addItemScript,
+				"lang":   "painless",
+				"params": params,
+			},
+		}, false)
+	}
+}
+
+// RemoveItemHandler returns a handler that removes the item with payload "itemId" from the array
+// field of a document. Empty arguments are read from meta "arrayField" and "itemIdField".
+// Removing from a missing document or array is a no-op.
+func (c *ConsumerService) RemoveItemHandler(arrayField, itemIDField string) EventHandler {
+	return func(evt *EventContext) error {
+		docID, err := evt.DocumentID()
+		if err != nil {
+			return err
+		}
+		field, idField, err := arrayFields(evt.Meta, arrayField, itemIDField)
+		if err != nil {
+			return err
+		}
+
+		itemID, exists := evt.Payload["itemId"]
+		if !exists || itemID == nil {
+			return fmt.Errorf("missing itemId in payload for document %s", docID)
+		}
+
+		log.Printf("Removing item %v from %s of document with ID %s", itemID, field, docID)
+		return c.updateDocument(evt.Context, evt.Index, docID, map[string]interface{}{
+			"script": map[string]interface{}{
+				"source": removeItemScript,
+				"lang":   "painless",
+				"params": map[string]interface{}{
+					"field":   field,
+					"idField": idField,
+					"itemId":  itemIDString(itemID),
+				},
+			},
+		}, true)
+	}
+}
+
+// arrayFields resolves the array field and item ID field of an array handler
+func arrayFields(meta map[string]interface{}, arrayField, itemIDField string) (string, string, error) {
+	if arrayField == "" {
+		arrayField, _ = meta["arrayField"].(string)
+	}
+	if arrayField == "" {
+		return "", "", errors.New("missing arrayField for array update")
+	}
+	if itemIDField == "" {
+		itemIDField, _ = meta["itemIdField"].(string)
+	}
+	if itemIDField == "" {
+		itemIDField = "id"
+	}
+	return arrayField, itemIDField, nil
+}
+
+// itemIDString formats an item ID the way the painless scripts compare it
+func itemIDString(value interface{}) string {
+	switch v := value.(type) {
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// updateDocument sends an _update request. With ignoreMissing a missing document is not an error.
+func (c *ConsumerService) updateDocument(ctx context.Context, index, docID string, body map[string]interface{}, ignoreMissing bool) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal update: %w", err)
+	}
+
+	if c.bulkIndexer != nil {
+		item := c.bulkItem(BulkActionUpdate, index, docID, data, nil)
+		item.RetryOnConflict = retryOnConflict
+
+		err := c.bulkIndexer.Add(ctx, item)
+		if ignoreMissing && isDocumentMissing(err) {
+			log.Printf("Skipped update of missing document %s in %s", docID, index)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update document %s: %w", docID, err)
+		}
+		return nil
+	}
+
+	res, err := c.esClient.Update(
+		index,
+		docID,
+		bytes.NewReader(data),
+		c.esClient.Update.WithContext(ctx),
+		c.esClient.Update.WithRetryOnConflict(retryOnConflict),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update document: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		err := fmt.Errorf("failed to update document %s: %w", docID, helpers.NewElasticsearchError(res))
+		if ignoreMissing && isDocumentMissing(err) {
+			log.Printf("Skipped update of missing document %s in %s", docID, index)
+			return nil
+		}
+		return err
+	}
+
+	log.Printf("Document updated in %s: %s", index, docID)
+	return nil
+}
+
+// isDocumentMissing reports whether an update failed because the document does not exist
+func isDocumentMissing(err error) bool {
+	var itemErr *BulkItemError
+	if errors.As(err, &itemErr) {
+		return itemErr.Type == documentMissingException
+	}
+	var esErr *helpers.ElasticsearchError
+	return errors.As(err, &esErr) && esErr.Type == documentMissingException
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/NHadi/AmanahPro-common/messagebroker"
+	"github.com/streadway/amqp"
+)
+
+// versionTypeExternal lets Elasticsearch keep the document with the highest version
+const versionTypeExternal = "external"
+
+// EnableExternalVersioning indexes and deletes documents with version_type=external, so an
+// older event processed after a newer one no longer overwrites the document. The version is
+// read from versionField in the payload (a number, numeric string or RFC3339 time; meta
+// "versionField" overrides it per event), which the producer must increase monotonically.
+// Events without a version are written unversioned: the envelope time is not used, since it
+// may have second resolution or be the time of consumption. Version conflicts are treated as
+// successful no-ops.
+func (c *ConsumerService) EnableExternalVersioning(versionField string) {
+	c.externalVersioning = true
+	c.versionField = versionField
+}
+
+// EnableOrderedProcessing routes events for the same document to the same worker,
+// so they are applied in the order they were received.
+func (c *ConsumerService) EnableOrderedProcessing() {
+	c.ordered = true
+}
+
+// documentVersion returns the external version of a document, or nil when versioning is disabled
+// or the event carries no version
+func (c *ConsumerService) documentVersion(payload map[string]interface{}, meta map[string]interface{}) (*int64, error) {
+	if !c.externalVersioning {
+		return nil, nil
+	}
+
+	field := c.versionField
+	if override, exists := meta["versionField"].(string); exists {
+		field = override
+	}
+
+	value, exists := payload[field]
+	if field == "" || !exists || value == nil {
+		log.Printf("No version in payload field %q, writing document without external versioning", field)
+		return nil, nil
+	}
+
+	version, err := parseVersion(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version field %s: %w", field, err)
+	}
+	return &version, nil
+}
+
+// parseVersion converts a number, numeric string or timestamp into a version.
+// Timestamps are converted to Unix nanoseconds.
+func parseVersion(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case float64:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := v.Float64()
+		return int64(f), err
+	case time.Time:
+		return v.UnixNano(), nil
+	case string:
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i, nil
+		}
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.UnixNano(), nil
+			}
+		}
+		return 0, fmt.Errorf("cannot parse %q as version", v)
+	default:
+		return 0, fmt.Errorf("unsupported version type %T", value)
+	}
+}
+
+// isVersionConflict reports whether an error is a 409 version conflict from Elasticsearch
+func isVersionConflict(err error) bool {
+	var itemErr *BulkItemError
+	return errors.As(err, &itemErr) && itemErr.Status == http.StatusConflict
+}
+
+// partitionKey returns the document ID of a delivery, used to keep per-document ordering
+func (c *ConsumerService) partitionKey(m amqp.Delivery) string {
+	event, err := messagebroker.ParseEvent(m.Body)
+	if err != nil {
+		return ""
+	}
+	if event.AggregateID != "" {
+		return event.AggregateID
+	}
+
+	payload, err := decodePayload(event.Payload)
+	if err != nil {
+		return ""
+	}
+	var options HandlerOptions
+	if entry, exists := c.handlers.resolve(event.Type); exists {
+		options = entry.options
+	}
+	id, _ := documentID(payload, event.Meta, options)
+	return id
+}
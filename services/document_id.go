@@ -0,0 +1,145 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DocumentID returns the Elasticsearch ID of the event's document.
+// It is built from, in order of precedence: meta "idTemplate", meta "idField",
+// the handler's IDTemplate, the handler's IDField, and finally the "id" field.
+func (evt *EventContext) DocumentID() (string, error) {
+	return documentID(evt.Payload, evt.Meta, evt.options)
+}
+
+// documentID extracts the document ID of a payload; see EventContext.DocumentID
+func documentID(payload map[string]interface{}, meta map[string]interface{}, options HandlerOptions) (string, error) {
+	if template, exists := meta["idTemplate"].(string); exists && template != "" {
+		return expandIDTemplate(template, payload)
+	}
+	if field, exists := meta["idField"].(string); exists && field != "" {
+		return idFieldValue(payload, field)
+	}
+	if options.IDTemplate != "" {
+		return expandIDTemplate(options.IDTemplate, payload)
+	}
+	if options.IDField != "" {
+		return idFieldValue(payload, options.IDField)
+	}
+	return idFieldValue(payload, "id")
+}
+
+// idFieldValue formats the value of a (dotted) payload field as a document ID
+func idFieldValue(payload map[string]interface{}, field string) (string, error) {
+	value, exists := lookupField(payload, field)
+	if !exists {
+		return "", fmt.Errorf("missing document ID (field: %s) in payload", field)
+	}
+	id, err := formatID(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid document ID (field: %s) in payload: %w", field, err)
+	}
+	return id, nil
+}
+
+// expandIDTemplate replaces each {field} in template with the formatted payload value,
+// e.g. "{organizationId}-{id}" becomes "12-345"
+func expandIDTemplate(template string, payload map[string]interface{}) (string, error) {
+	var id strings.Builder
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			id.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated placeholder in ID template %q", template)
+		}
+		end += start
+
+		id.WriteString(rest[:start])
+		value, err := idFieldValue(payload, rest[start+1:end])
+		if err != nil {
+			return "", err
+		}
+		id.WriteString(value)
+		rest = rest[end+1:]
+	}
+
+	if id.Len() == 0 {
+		return "", fmt.Errorf("ID template %q produced an empty ID", template)
+	}
+	return id.String(), nil
+}
+
+// lookupField returns a payload value by field name; dots address nested objects
+func lookupField(payload map[string]interface{}, field string) (interface{}, bool) {
+	if value, exists := payload[field]; exists {
+		return value, value != nil
+	}
+
+	var current interface{} = payload
+	for _, part := range strings.Split(field, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, current != nil
+}
+
+// formatID converts a string or integer ID into its string form without float formatting
+func formatID(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return "", fmt.Errorf("empty string")
+		}
+		return v, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return strconv.FormatInt(i, 10), nil
+		}
+		if _, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return v.String(), nil
+		}
+		return "", fmt.Errorf("%s is not an integer", v)
+	case float64:
+		if v != math.Trunc(v) || math.Abs(v) >= 1<<53 {
+			return "", fmt.Errorf("%v is not an exact integer", v)
+		}
+		return strconv.FormatInt(int64(v), 10), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	default:
+		return "", fmt.Errorf("unsupported type %T", value)
+	}
+}
+
+// decodePayload decodes an event payload keeping numbers as json.Number, so large integer IDs keep their precision
+func decodePayload(data []byte) (map[string]interface{}, error) {
+	var payload map[string]interface{}
+	if len(data) == 0 {
+		return payload, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
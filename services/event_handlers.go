@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/NHadi/AmanahPro-common/messagebroker"
+)
+
+// EventContext carries an event through middleware to its handler
+type EventContext struct {
+	Context        context.Context
+	Event          *messagebroker.Event
+	Payload        map[string]interface{} // Numbers are decoded as json.Number
+	Meta           map[string]interface{}
+	Index          string // Target index for this event
+	OrganizationID *int   // Tenant of the event when tenancy is enabled
+	baseIndex      string // Index before tenant routing
+	key            string // Deduplication key of the event
+	options        HandlerOptions
+}
+
+// EventHandler processes one event
+type EventHandler func(evt *EventContext) error
+
+// HandlerMiddleware wraps an EventHandler, e.g. for logging, metrics or recovery
+type HandlerMiddleware func(next EventHandler) EventHandler
+
+// HandlerOptions configures a registered handler
+type HandlerOptions struct {
+	Index      string              // Index used instead of the consumer's default index
+	IDField    string              // Payload field holding the document ID, instead of "id"
+	IDTemplate string              // Composite document ID such as "{organizationId}-{id}"
+	Middleware []HandlerMiddleware // Middleware applied to this handler only, inside the global middleware
+}
+
+type registeredHandler struct {
+	pattern string
+	handler EventHandler
+	options HandlerOptions
+}
+
+// handlerRegistry resolves event types to handlers.
+// Exact matches win over patterns; patterns use path.Match syntax (e.g. "Sph*") and are
+// tried in registration order; the default handler is used when nothing matches.
+type handlerRegistry struct {
+	exact          map[string]registeredHandler
+	patterns       []registeredHandler
+	defaultHandler *registeredHandler
+	middleware     []HandlerMiddleware
+	mutex          sync.RWMutex
+}
+
+func newHandlerRegistry() *handlerRegistry {
+	return &handlerRegistry{
+		exact: make(map[string]registeredHandler),
+	}
+}
+
+func (r *handlerRegistry) register(pattern string, handler EventHandler, options HandlerOptions) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry := registeredHandler{pattern: pattern, handler: handler, options: options}
+	if !isPattern(pattern) {
+		r.exact[pattern] = entry
+		return
+	}
+	for i, existing := range r.patterns {
+		if existing.pattern == pattern {
+			r.patterns[i] = entry
+			return
+		}
+	}
+	r.patterns = append(r.patterns, entry)
+}
+
+func (r *handlerRegistry) resolve(eventType string) (registeredHandler, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if entry, exists := r.exact[eventType]; exists {
+		return entry, true
+	}
+	for _, entry := range r.patterns {
+		if matched, _ := path.Match(entry.pattern, eventType); matched {
+			return entry, true
+		}
+	}
+	if r.defaultHandler != nil {
+		return *r.defaultHandler, true
+	}
+	return registeredHandler{}, false
+}
+
+// chain wraps a handler with its own middleware and then the global middleware
+func (r *handlerRegistry) chain(entry registeredHandler) EventHandler {
+	r.mutex.RLock()
+	global := append([]HandlerMiddleware(nil), r.middleware...)
+	r.mutex.RUnlock()
+
+	handler := entry.handler
+	for i := len(entry.options.Middleware) - 1; i >= 0; i-- {
+		handler = entry.options.Middleware[i](handler)
+	}
+	for i := len(global) - 1; i >= 0; i-- {
+		handler = global[i](handler)
+	}
+	return handler
+}
+
+// isPattern reports whether an event type contains path.Match wildcards
+func isPattern(pattern string) bool {
+	for _, ch := range pattern {
+		switch ch {
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterHandler registers a handler for an event type or pattern such as "Sph*".
+// Registering the same type again replaces the previous handler.
+func (c *ConsumerService) RegisterHandler(eventType string, handler EventHandler) {
+	c.handlers.register(eventType, handler, HandlerOptions{})
+}
+
+// RegisterHandlerWithOptions registers a handler with its own target index, document ID and middleware
+func (c *ConsumerService) RegisterHandlerWithOptions(eventType string, handler EventHandler, options HandlerOptions) {
+	c.handlers.register(eventType, handler, options)
+}
+
+// SetDefaultHandler sets the handler for events that match no registered type.
+// Without a default handler, unknown events are acknowledged and skipped.
+func (c *ConsumerService) SetDefaultHandler(handler EventHandler, options HandlerOptions) {
+	c.handlers.mutex.Lock()
+	defer c.handlers.mutex.Unlock()
+	c.handlers.defaultHandler = &registeredHandler{pattern: "*", handler: handler, options: options}
+}
+
+// Use appends middleware applied to every handler, outermost first
+func (c *ConsumerService) Use(middleware ...HandlerMiddleware) {
+	c.handlers.mutex.Lock()
+	defer c.handlers.mutex.Unlock()
+	c.handlers.middleware = append(c.handlers.middleware, middleware...)
+}
+
+// IndexHandler returns the built-in handler that indexes the payload as a document
+func (c *ConsumerService) IndexHandler() EventHandler {
+	return c.handleCreatedOrUpdated
+}
+
+// DeleteHandler returns the built-in handler that deletes the document of the payload
+func (c *ConsumerService) DeleteHandler() EventHandler {
+	return c.handleDeleted
+}
+
+// RegisterTypedHandler registers a handler that receives the payload decoded into T
+func RegisterTypedHandler[T any](c *ConsumerService, eventType string, handler func(evt *EventContext, payload T) error) {
+	c.RegisterHandler(eventType, func(evt *EventContext) error {
+		payload, err := messagebroker.DecodePayload[T](evt.Event)
+		if err != nil {
+			return err
+		}
+		return handler(evt, payload)
+	})
+}
+
+// LoggingMiddleware logs each event with its duration and outcome
+func LoggingMiddleware() HandlerMiddleware {
+	return func(next EventHandler) EventHandler {
+		return func(evt *EventContext) error {
+			start := time.Now()
+			err := next(evt)
+			if err != nil {
+				log.Printf("Event %s (id=%s, traceId=%s) failed after %v: %v", evt.Event.Type, evt.Event.ID, evt.Event.TraceID, time.Since(start), err)
+			} else {
+				log.Printf("Event %s (id=%s, traceId=%s) handled in %v", evt.Event.Type, evt.Event.ID, evt.Event.TraceID, time.Since(start))
+			}
+			return err
+		}
+	}
+}
+
+// RecoveryMiddleware turns a panic in a handler into an error so the message is retried instead of crashing the worker
+func RecoveryMiddleware() HandlerMiddleware {
+	return func(next EventHandler) EventHandler {
+		return func(evt *EventContext) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Recovered from panic in handler for event %s: %v\n%s", evt.Event.Type, r, debug.Stack())
+					err = fmt.Errorf("panic in handler for event %s: %v", evt.Event.Type, r)
+				}
+			}()
+			return next(evt)
+		}
+	}
+}
+
+// MetricsMiddleware reports the duration and outcome of each event to observe
+func MetricsMiddleware(observe func(eventType string, duration time.Duration, err error)) HandlerMiddleware {
+	return func(next EventHandler) EventHandler {
+		return func(evt *EventContext) error {
+			start := time.Now()
+			err := next(evt)
+			observe(evt.Event.Type, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// TracingMiddleware stores the event trace ID in the handler context under "trace_id",
+// the key read by logger.Logger
+func TracingMiddleware() HandlerMiddleware {
+	return func(next EventHandler) EventHandler {
+		return func(evt *EventContext) error {
+			if evt.Event.TraceID != "" {
+				evt.Context = context.WithValue(evt.Context, "trace_id", evt.Event.TraceID)
+			}
+			return next(evt)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Idempotency statuses
+const (
+	IdempotencyProcessing = "processing"
+	IdempotencyCompleted  = "completed"
+	IdempotencyFailed     = "failed"
+)
+
+// IdempotencyRecord is the stored outcome of processing one event
+type IdempotencyRecord struct {
+	Status    string    `json:"status"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// IdempotencyStore remembers which events were already processed
+type IdempotencyStore interface {
+	// Begin claims a key for processing. It returns false when the key is already being
+	// processed or was completed; failed keys can be claimed again.
+	Begin(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Complete records a successful outcome that is kept for ttl
+	Complete(ctx context.Context, key string, ttl time.Duration) error
+	// Fail records a failed outcome so the key can be claimed again by a retry
+	Fail(ctx context.Context, key string, reason error, ttl time.Duration) error
+	// Get returns the stored record, or nil if there is none
+	Get(ctx context.Context, key string) (*IdempotencyRecord, error)
+}
+
+// claimScript sets the key to "processing" unless it exists with a status other than "failed"
+var claimScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current and not string.find(current, '"status":"failed"', 1, true) then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+// RedisIdempotencyStore keeps idempotency records in Redis, e.g. the client from persistence.InitializeRedis
+type RedisIdempotencyStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisIdempotencyStore creates a Redis-backed store; keys are prefixed with prefix
+func NewRedisIdempotencyStore(client *redis.Client, prefix string) *RedisIdempotencyStore {
+	return &RedisIdempotencyStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// Begin claims a key for processing
+func (s *RedisIdempotencyStore) Begin(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	data, err := encodeIdempotencyRecord(IdempotencyProcessing, nil)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := claimScript.Run(ctx, s.client, []string{s.prefix + key}, data, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim idempotency key %s: %w", key, err)
+	}
+	return claimed == 1, nil
+}
+
+// Complete records a successful outcome
+func (s *RedisIdempotencyStore) Complete(ctx context.Context, key string, ttl time.Duration) error {
+	return s.set(ctx, key, IdempotencyCompleted, nil, ttl)
+}
+
+// Fail records a failed outcome
+func (s *RedisIdempotencyStore) Fail(ctx context.Context, key string, reason error, ttl time.Duration) error {
+	return s.set(ctx, key, IdempotencyFailed, reason, ttl)
+}
+
+// Get returns the stored record
+func (s *RedisIdempotencyStore) Get(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	data, err := s.client.Get(ctx, s.prefix+key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read idempotency key %s: %w", key, err)
+	}
+
+	var record IdempotencyRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, fmt.Errorf("failed to parse idempotency record %s: %w", key, err)
+	}
+	return &record, nil
+}
+
+func (s *RedisIdempotencyStore) set(ctx context.Context, key, status string, reason error, ttl time.Duration) error {
+	data, err := encodeIdempotencyRecord(status, reason)
+	if err != nil {
+		return err
+	}
+	if err := s.client.Set(ctx, s.prefix+key, data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store idempotency key %s: %w", key, err)
+	}
+	return nil
+}
+
+func encodeIdempotencyRecord(status string, reason error) (string, error) {
+	record := IdempotencyRecord{
+		Status:    status,
+		UpdatedAt: time.Now().UTC(),
+	}
+	if reason != nil {
+		record.Error = reason.Error()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+	return string(data), nil
+}
+
+// MemoryIdempotencyStore keeps idempotency records in memory; intended for tests and single-instance tools
+type MemoryIdempotencyStore struct {
+	records map[string]memoryIdempotencyEntry
+	mutex   sync.Mutex
+}
+
+type memoryIdempotencyEntry struct {
+	record    IdempotencyRecord
+	expiresAt time.Time
+}
+
+// NewMemoryIdempotencyStore creates an in-memory store
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		records: make(map[string]memoryIdempotencyEntry),
+	}
+}
+
+// Begin claims a key for processing
+func (s *MemoryIdempotencyStore) Begin(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if entry, exists := s.lookup(key); exists && entry.record.Status != IdempotencyFailed {
+		return false, nil
+	}
+	s.store(key, IdempotencyProcessing, nil, ttl)
+	return true, nil
+}
+
+// Complete records a successful outcome
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, key string, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store(key, IdempotencyCompleted, nil, ttl)
+	return nil
+}
+
+// Fail records a failed outcome
+func (s *MemoryIdempotencyStore) Fail(ctx context.Context, key string, reason error, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store(key, IdempotencyFailed, reason, ttl)
+	return nil
+}
+
+// Get returns the stored record
+func (s *MemoryIdempotencyStore) Get(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, exists := s.lookup(key)
+	if !exists {
+		return nil, nil
+	}
+	record := entry.record
+	return &record, nil
+}
+
+// lookup returns an unexpired entry. Must be called with mutex held.
+func (s *MemoryIdempotencyStore) lookup(key string) (memoryIdempotencyEntry, bool) {
+	entry, exists := s.records[key]
+	if exists && !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		delete(s.records, key)
+		return entry, false
+	}
+	return entry, exists
+}
+
+// store saves an entry. Must be called with mutex held.
+func (s *MemoryIdempotencyStore) store(key, status string, reason error, ttl time.Duration) {
+	entry := memoryIdempotencyEntry{
+		record: IdempotencyRecord{
+			Status:    status,
+			UpdatedAt: time.Now().UTC(),
+		},
+	}
+	if reason != nil {
+		entry.record.Error = reason.Error()
+	}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+	s.records[key] = entry
+}
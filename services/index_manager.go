@@ -0,0 +1,416 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/NHadi/AmanahPro-common/helpers"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// IndexDefinition declares the settings and mappings of a resource index.
+// Readers and writers use the alias Name; documents live in a versioned index
+// "<name>_v<version>" so mappings can change by creating a new version.
+type IndexDefinition struct {
+	Name     string
+	Version  int
+	Settings map[string]interface{}
+	Mappings map[string]interface{}
+}
+
+// IndexName returns the versioned index behind the alias
+func (d IndexDefinition) IndexName() string {
+	return fmt.Sprintf("%s_v%d", d.Name, d.Version)
+}
+
+// IndexTemplate declares settings and mappings applied to every new index matching Patterns,
+// e.g. the per-organization indices created on first write
+type IndexTemplate struct {
+	Name     string
+	Patterns []string
+	Priority int
+	Settings map[string]interface{}
+	Mappings map[string]interface{}
+	Aliases  map[string]interface{}
+}
+
+// ReindexOptions controls how Migrate fills a new index version
+type ReindexOptions struct {
+	// Backfill fills the target index, e.g. by publishing "Reindexed" events for every record,
+	// and returns once they are indexed. When nil, documents are copied from the current index
+	// with the _reindex API.
+	Backfill func(ctx context.Context, target string) error
+	// Consumer, when set, writes "Reindexed" events to the target index and dual-writes all
+	// other events to the current and target index until the alias is swapped. The dual-write
+	// state lives in this process only: other replicas of the consumer keep writing to the
+	// current index, so scale the consumer to a single replica during a migration.
+	Consumer *ConsumerService
+	// DeleteOld removes the previous index after the alias swap
+	DeleteOld bool
+}
+
+// IndexManager creates versioned indices, templates and aliases
+type IndexManager struct {
+	esClient *elasticsearch.Client
+}
+
+// NewIndexManager creates an index manager
+func NewIndexManager(esClient *elasticsearch.Client) *IndexManager {
+	return &IndexManager{esClient: esClient}
+}
+
+// PutTemplate creates or replaces an index template
+func (m *IndexManager) PutTemplate(ctx context.Context, template IndexTemplate) error {
+	definition := map[string]interface{}{}
+	if template.Settings != nil {
+		definition["settings"] = template.Settings
+	}
+	if template.Mappings != nil {
+		definition["mappings"] = template.Mappings
+	}
+	if template.Aliases != nil {
+		definition["aliases"] = template.Aliases
+	}
+
+	body, err := helpers.MapToReader(map[string]interface{}{
+		"index_patterns": template.Patterns,
+		"priority":       template.Priority,
+		"template":       definition,
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := m.esClient.Indices.PutIndexTemplate(template.Name, body, m.esClient.Indices.PutIndexTemplate.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to put index template %s: %w", template.Name, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError(res, "put index template "+template.Name)
+	}
+
+	log.Printf("Index template %s applied to %v", template.Name, template.Patterns)
+	return nil
+}
+
+// CreateIndex creates the versioned index of a definition unless it already exists
+func (m *IndexManager) CreateIndex(ctx context.Context, definition IndexDefinition) (bool, error) {
+	index := definition.IndexName()
+	exists, err := m.indexExists(ctx, index)
+	if err != nil || exists {
+		return false, err
+	}
+
+	spec := map[string]interface{}{}
+	if definition.Settings != nil {
+		spec["settings"] = definition.Settings
+	}
+	if definition.Mappings != nil {
+		spec["mappings"] = definition.Mappings
+	}
+	body, err := helpers.MapToReader(spec)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := m.esClient.Indices.Create(index,
+		m.esClient.Indices.Create.WithBody(body),
+		m.esClient.Indices.Create.WithContext(ctx),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to create index %s: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		esErr := helpers.NewElasticsearchError(res)
+		if esErr.Type == "resource_already_exists_exception" {
+			return false, nil // Created concurrently
+		}
+		return false, fmt.Errorf("failed to create index %s: %w", index, esErr)
+	}
+
+	log.Printf("Index %s created", index)
+	return true, nil
+}
+
+// AliasTargets returns the indices an alias points to, sorted by name.
+// A concrete index with the alias name, left over from implicit index creation, is returned as legacy.
+func (m *IndexManager) AliasTargets(ctx context.Context, alias string) (indices []string, legacy bool, err error) {
+	res, err := m.esClient.Indices.GetAlias(
+		m.esClient.Indices.GetAlias.WithName(alias),
+		m.esClient.Indices.GetAlias.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get alias %s: %w", alias, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		exists, err := m.indexExists(ctx, alias)
+		if err != nil {
+			return nil, false, err
+		}
+		if exists {
+			return []string{alias}, true, nil
+		}
+		return nil, false, nil
+	}
+	if res.IsError() {
+		return nil, false, responseError(res, "get alias "+alias)
+	}
+
+	var targets map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&targets); err != nil {
+		return nil, false, fmt.Errorf("failed to decode alias %s: %w", alias, err)
+	}
+	for index := range targets {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	return indices, false, nil
+}
+
+// SwapAlias atomically points the alias at index, removing it from every other index.
+// Other aliases of the previous indices, such as filtered per-organization aliases, move to
+// index with their filter and routing. A legacy concrete index with the alias name is deleted
+// in the same request.
+func (m *IndexManager) SwapAlias(ctx context.Context, alias, index string) error {
+	current, legacy, err := m.AliasTargets(ctx, alias)
+	if err != nil {
+		return err
+	}
+
+	var actions []interface{}
+	moved := make(map[string]bool)
+	for _, old := range current {
+		if old == index {
+			continue
+		}
+
+		aliases, err := m.indexAliases(ctx, old)
+		if err != nil {
+			return err
+		}
+		for name, spec := range aliases {
+			if name == alias {
+				continue
+			}
+			if !legacy {
+				actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"index": old, "alias": name}})
+			}
+			if moved[name] {
+				continue
+			}
+			moved[name] = true
+			spec["index"] = index
+			spec["alias"] = name
+			actions = append(actions, map[string]interface{}{"add": spec})
+		}
+
+		if legacy {
+			actions = append(actions, map[string]interface{}{"remove_index": map[string]interface{}{"index": old}})
+		} else {
+			actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"index": old, "alias": alias}})
+		}
+	}
+	actions = append(actions, map[string]interface{}{
+		"add": map[string]interface{}{"index": index, "alias": alias, "is_write_index": true},
+	})
+
+	body, err := helpers.MapToReader(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+
+	res, err := m.esClient.Indices.UpdateAliases(body, m.esClient.Indices.UpdateAliases.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to swap alias %s: %w", alias, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError(res, "swap alias "+alias)
+	}
+
+	log.Printf("Alias %s now points to %s", alias, index)
+	return nil
+}
+
+// indexAliases returns the aliases of a concrete index with their filter, routing and flags
+func (m *IndexManager) indexAliases(ctx context.Context, index string) (map[string]map[string]interface{}, error) {
+	res, err := m.esClient.Indices.GetAlias(
+		m.esClient.Indices.GetAlias.WithIndex(index),
+		m.esClient.Indices.GetAlias.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aliases of %s: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, responseError(res, "get aliases of "+index)
+	}
+
+	var result map[string]struct {
+		Aliases map[string]map[string]interface{} `json:"aliases"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode aliases of %s: %w", index, err)
+	}
+	return result[index].Aliases, nil
+}
+
+// DeleteIndex deletes an index
+func (m *IndexManager) DeleteIndex(ctx context.Context, index string) error {
+	res, err := m.esClient.Indices.Delete([]string{index}, m.esClient.Indices.Delete.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to delete index %s: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return responseError(res, "delete index "+index)
+	}
+	return nil
+}
+
+// Migrate brings the alias of a definition to its current version and is safe to call on every
+// service startup. A new alias is created pointing at the versioned index. When the alias points
+// at an older index (or is a legacy concrete index), the new version is created, backfilled, and
+// the alias is swapped atomically, so readers never see an empty or partial index.
+// Use EnableExternalVersioning on the consumer so backfilled snapshots never overwrite newer writes.
+func (m *IndexManager) Migrate(ctx context.Context, definition IndexDefinition, options ReindexOptions) error {
+	target := definition.IndexName()
+
+	current, _, err := m.AliasTargets(ctx, definition.Name)
+	if err != nil {
+		return err
+	}
+	if len(current) == 1 && current[0] == target {
+		return nil // Already on this version
+	}
+
+	if _, err := m.CreateIndex(ctx, definition); err != nil {
+		return err
+	}
+	if len(current) == 0 {
+		return m.SwapAlias(ctx, definition.Name, target)
+	}
+
+	log.Printf("Migrating %s from %v to %s", definition.Name, current, target)
+
+	if options.Consumer != nil {
+		options.Consumer.beginReindex(definition.Name, target)
+		defer options.Consumer.endReindex(definition.Name)
+	}
+
+	if options.Backfill != nil {
+		err = options.Backfill(ctx, target)
+	} else {
+		err = m.copyDocuments(ctx, current, target)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to backfill %s: %w", target, err)
+	}
+
+	if err := m.refresh(ctx, target); err != nil {
+		return err
+	}
+	if err := m.SwapAlias(ctx, definition.Name, target); err != nil {
+		return err
+	}
+
+	if options.DeleteOld {
+		for _, old := range current {
+			if old == definition.Name {
+				continue // Legacy index was removed by the swap
+			}
+			if err := m.DeleteIndex(ctx, old); err != nil {
+				log.Printf("Failed to delete old index %s: %v", old, err)
+			}
+		}
+	}
+	return nil
+}
+
+// copyDocuments copies documents into target with the _reindex API, keeping their versions
+func (m *IndexManager) copyDocuments(ctx context.Context, sources []string, target string) error {
+	body, err := helpers.MapToReader(map[string]interface{}{
+		"conflicts": "proceed",
+		"source":    map[string]interface{}{"index": sources},
+		"dest":      map[string]interface{}{"index": target, "version_type": versionTypeExternal},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := m.esClient.Reindex(body,
+		m.esClient.Reindex.WithWaitForCompletion(true),
+		m.esClient.Reindex.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to reindex into %s: %w", target, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError(res, "reindex into "+target)
+	}
+
+	var result struct {
+		Total    int           `json:"total"`
+		Failures []interface{} `json:"failures"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode reindex response: %w", err)
+	}
+	if len(result.Failures) > 0 {
+		return fmt.Errorf("reindex into %s had %d failures", target, len(result.Failures))
+	}
+
+	log.Printf("Copied %d documents into %s", result.Total, target)
+	return nil
+}
+
+// refresh makes recent writes to an index searchable
+func (m *IndexManager) refresh(ctx context.Context, index string) error {
+	res, err := m.esClient.Indices.Refresh(
+		m.esClient.Indices.Refresh.WithIndex(index),
+		m.esClient.Indices.Refresh.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to refresh index %s: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError(res, "refresh index "+index)
+	}
+	return nil
+}
+
+// indexExists reports whether a concrete index or alias exists
+func (m *IndexManager) indexExists(ctx context.Context, index string) (bool, error) {
+	res, err := m.esClient.Indices.Exists([]string{index}, m.esClient.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return false, fmt.Errorf("failed to check index %s: %w", index, err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, responseError(res, "check index "+index)
+	}
+}
+
+// responseError converts an Elasticsearch error response into an error
+func responseError(res *esapi.Response, action string) error {
+	body, _ := io.ReadAll(res.Body)
+	return fmt.Errorf("failed to %s: %s: %s", action, res.Status(), body)
+}